@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	TgAccessOpen      = "open"
+	TgAccessAllowlist = "allowlist"
+)
+
+// TgZeAccess is kept in the state as it is changed with the /allow /deny /access commands
+type TgZeAccess struct {
+	// Mode overrides TgAccessMode of the config if set
+	Mode string `yaml:"Mode,omitempty"`
+
+	AllowUserIds []int64 `yaml:"AllowUserIds,flow"`
+	AllowChatIds []int64 `yaml:"AllowChatIds,flow"`
+	DenyUserIds  []int64 `yaml:"DenyUserIds,flow"`
+	DenyChatIds  []int64 `yaml:"DenyChatIds,flow"`
+}
+
+func accessMode() string {
+	StateMutex.Lock()
+	mode := State.TgAccess.Mode
+	StateMutex.Unlock()
+	if mode == "" {
+		mode = Config().TgAccessMode
+	}
+	return mode
+}
+
+// accessAllowed reports if the user can download in the chat, the denylist wins over the allowlist and the mode
+func accessAllowed(userid, chatid int64) bool {
+	if roleAllowed(userid, RoleModerator) {
+		return true
+	}
+
+	mode := accessMode()
+
+	StateMutex.Lock()
+	defer StateMutex.Unlock()
+	a := State.TgAccess
+
+	if (userid != 0 && slices.Contains(a.DenyUserIds, userid)) || slices.Contains(a.DenyChatIds, chatid) {
+		return false
+	}
+	if mode == TgAccessOpen {
+		return true
+	}
+	return (userid != 0 && slices.Contains(a.AllowUserIds, userid)) || slices.Contains(a.AllowChatIds, chatid)
+}
+
+// accessDenied replies to the denied request and reports it to the admin chat
+func accessDenied(m TgMessage) {
+	log("access denied from:`%s` id:%d chat:%d", m.From.Username, m.From.Id, m.Chat.Id)
+	audit(m, "download", "denied", "access")
+
+	_, err := tgsendMessage("sorry, downloads are not available here, please ask the bot owner for access", m.Chat.Id, "", m.MessageId)
+	if err != nil {
+		log("tgsendMessage: %v", err)
+	}
+
+	report := fmt.Sprintf(
+		"*Access denied*"+NL+
+			"from: username:@%s id:`%d`"+NL+
+			"chat: id:`%d` username:@%s type:%s title:%s"+NL+
+			"text:"+NL+
+			"```"+NL+
+			"%s"+NL+
+			"```",
+		m.From.Username, m.From.Id,
+		m.Chat.Id, m.Chat.Username, m.Chat.Type, tgescape(m.Chat.Title),
+		m.Text,
+	)
+	tgreport(report)
+}
+
+// processTgAccessCommand handles `/allow user|chat <id>`, `/deny user|chat <id>`
+// and `/access [open|allowlist|remove user|chat <id>]`, it returns false if the text is not one of them
+func processTgAccessCommand(m TgMessage) bool {
+	ff := strings.Fields(m.Text)
+	if len(ff) == 0 {
+		return false
+	}
+	cmd, _, _ := strings.Cut(ff[0], "@")
+	if cmd != "/allow" && cmd != "/deny" && cmd != "/access" {
+		return false
+	}
+
+	// moderators can deny, allowing and changing the mode is for admins
+	role := RoleAdmin
+	if cmd == "/deny" {
+		role = RoleModerator
+	}
+	if !roleAllowed(m.From.Id, role) {
+		roleDenied(m, cmd, role)
+		return true
+	}
+
+	var reply string
+	if r, err := accessCommand(cmd, ff[1:]); err != nil {
+		reply = fmt.Sprintf("ERROR %v", err)
+	} else {
+		reply = r
+		if len(ff) > 1 {
+			audit(m, cmd, "ok", strings.Join(ff[1:], " "))
+		}
+	}
+
+	if _, err := tgsendMessage(reply, m.Chat.Id, "", m.MessageId); err != nil {
+		log("tgsendMessage: %v", err)
+	}
+
+	return true
+}
+
+func accessCommand(cmd string, args []string) (reply string, err error) {
+	if cmd == "/access" && len(args) == 0 {
+		return accessStatus(), nil
+	}
+
+	if cmd == "/access" && len(args) == 1 {
+		mode := args[0]
+		if mode != TgAccessOpen && mode != TgAccessAllowlist {
+			return "", fmt.Errorf("mode should be %s or %s", TgAccessOpen, TgAccessAllowlist)
+		}
+		if err := stateUpdate(func(state *TgZeState) { state.TgAccess.Mode = mode }); err != nil {
+			return "", fmt.Errorf("stateUpdate: %w", err)
+		}
+		log("access mode set to %s", mode)
+		return fmt.Sprintf("access mode %s", mode), nil
+	}
+
+	if cmd == "/access" {
+		if args[0] != "remove" {
+			return "", fmt.Errorf("usage: /access [open|allowlist|remove user|chat <id>]")
+		}
+		args = args[1:]
+	}
+
+	if len(args) != 2 || (args[0] != "user" && args[0] != "chat") {
+		return "", fmt.Errorf("usage: %s user|chat <id>", cmd)
+	}
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid id %s", args[1])
+	}
+	user := args[0] == "user"
+
+	err = stateUpdate(func(state *TgZeState) {
+		a := &state.TgAccess
+		allow, deny := &a.AllowChatIds, &a.DenyChatIds
+		if user {
+			allow, deny = &a.AllowUserIds, &a.DenyUserIds
+		}
+		*allow = slices.DeleteFunc(*allow, func(i int64) bool { return i == id })
+		*deny = slices.DeleteFunc(*deny, func(i int64) bool { return i == id })
+		switch cmd {
+		case "/allow":
+			*allow = append(*allow, id)
+		case "/deny":
+			*deny = append(*deny, id)
+		}
+	})
+	if err != nil {
+		return "", fmt.Errorf("stateUpdate: %w", err)
+	}
+
+	log("access %s %s %d", cmd, args[0], id)
+
+	switch cmd {
+	case "/allow":
+		return fmt.Sprintf("%s %d allowed", args[0], id), nil
+	case "/deny":
+		return fmt.Sprintf("%s %d denied", args[0], id), nil
+	}
+	return fmt.Sprintf("%s %d removed from the lists", args[0], id), nil
+}
+
+func accessStatus() string {
+	mode := accessMode()
+	StateMutex.Lock()
+	defer StateMutex.Unlock()
+	a := State.TgAccess
+	return fmt.Sprintf(
+		"mode: %s"+NL+
+			"allowed users: %v"+NL+
+			"allowed chats: %v"+NL+
+			"denied users: %v"+NL+
+			"denied chats: %v",
+		mode, a.AllowUserIds, a.AllowChatIds, a.DenyUserIds, a.DenyChatIds,
+	)
+}
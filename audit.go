@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of the audit log, who did what where and how it ended
+type AuditEntry struct {
+	Time     time.Time     `json:"time" yaml:"Time"`
+	UserId   int64         `json:"user_id" yaml:"UserId"`
+	Username string        `json:"username,omitempty" yaml:"Username,omitempty"`
+	ChatId   int64         `json:"chat_id" yaml:"ChatId"`
+	Command  string        `json:"command" yaml:"Command"`
+	VideoIds []string      `json:"video_ids,omitempty" yaml:"VideoIds,flow,omitempty"`
+	Format   string        `json:"format,omitempty" yaml:"Format,omitempty"`
+	Bytes    int64         `json:"bytes,omitempty" yaml:"Bytes,omitempty"`
+	Outcome  string        `json:"outcome" yaml:"Outcome"`
+	Class    ErrClass      `json:"class,omitempty" yaml:"Class,omitempty"`
+	Details  string        `json:"details,omitempty" yaml:"Details,omitempty"`
+	Elapsed  time.Duration `json:"elapsed,omitempty" yaml:"Elapsed,omitempty"`
+}
+
+var (
+	AuditMutex sync.Mutex
+	// AuditPending are the entries not saved to the state yet when AuditPath is not set
+	AuditPending []AuditEntry
+)
+
+// audit writes the command to the audit log with who sent it and where
+func audit(m TgMessage, command, outcome, details string) {
+	ctx := logWith(Ctx, "chat_id", m.Chat.Id, "user_id", m.From.Id)
+	auditWrite(ctx, AuditEntry{
+		UserId:   m.From.Id,
+		Username: m.From.Username,
+		ChatId:   m.Chat.Id,
+		Command:  command,
+		Outcome:  outcome,
+		Details:  details,
+	})
+}
+
+// auditWrite appends the entry to the AuditPath file as a json line or to the entries for the state saved by auditFlush
+func auditWrite(ctx context.Context, e AuditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	// the details are error texts that can have the urls with the telegram token or the youtube key
+	e.Details = redact(e.Details)
+
+	ebb, err := json.Marshal(e)
+	if err != nil {
+		logctx(ctx, "ERROR json.Marshal: %v", err)
+		return
+	}
+	logctx(ctx, "audit %s", ebb)
+
+	AuditMutex.Lock()
+	defer AuditMutex.Unlock()
+
+	path := Config().AuditPath
+	if path == "" {
+		AuditPending = append(AuditPending, e)
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logctx(ctx, "ERROR os.OpenFile `%s`: %v", path, err)
+		return
+	}
+	if _, err := f.Write(append(ebb, '\n')); err != nil {
+		logctx(ctx, "ERROR os.File.Write `%s`: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		logctx(ctx, "ERROR os.File.Close `%s`: %v", path, err)
+	}
+}
+
+// auditFlush saves the pending entries to the ring of the last entries in the state in one write
+func auditFlush() {
+	AuditMutex.Lock()
+	defer AuditMutex.Unlock()
+	if len(AuditPending) == 0 {
+		return
+	}
+
+	maxsize := Config().AuditStateMaxSize
+	err := stateUpdate(func(state *TgZeState) {
+		state.TgAudit = append(state.TgAudit, AuditPending...)
+		if len(state.TgAudit) > maxsize {
+			state.TgAudit = state.TgAudit[len(state.TgAudit)-maxsize:]
+		}
+	})
+	if err != nil {
+		log("ERROR stateUpdate: %v", err)
+		// the entries are kept for the next flush but not more than the state keeps
+		if len(AuditPending) > maxsize {
+			AuditPending = AuditPending[len(AuditPending)-maxsize:]
+		}
+		return
+	}
+	AuditPending = nil
+}
+
+func auditFlushLoop() {
+	for {
+		time.Sleep(Config().AuditStateFlushInterval)
+		auditFlush()
+	}
+}
+
+// auditRecent returns the last entries from the end of the file or the state, the file is read from its last 4mb only
+func auditRecent() (ee []AuditEntry, err error) {
+	AuditMutex.Lock()
+	defer AuditMutex.Unlock()
+
+	path := Config().AuditPath
+	if path == "" {
+		StateMutex.Lock()
+		defer StateMutex.Unlock()
+		ee = append([]AuditEntry(nil), State.TgAudit...)
+		return append(ee, AuditPending...), nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	const tailsize = 4 << 20
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var skipfirst bool
+	if fi.Size() > tailsize {
+		if _, err := f.Seek(fi.Size()-tailsize, io.SeekStart); err != nil {
+			return nil, err
+		}
+		skipfirst = true
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if skipfirst {
+			// the first line after the seek is most likely a part of a line
+			skipfirst = false
+			continue
+		}
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			log("WARNING audit json.Unmarshal: %v", err)
+			continue
+		}
+		ee = append(ee, e)
+	}
+	return ee, scanner.Err()
+}
+
+// processTgAuditCommand handles `/audit [user|chat|video <id>] [<count>]` for the bot admins
+func processTgAuditCommand(m TgMessage) bool {
+	ff := strings.Fields(m.Text)
+	if len(ff) == 0 {
+		return false
+	}
+	if cmd, _, _ := strings.Cut(ff[0], "@"); cmd != "/audit" {
+		return false
+	}
+
+	if !roleAllowed(m.From.Id, RoleAdmin) {
+		roleDenied(m, "/audit", RoleAdmin)
+		return true
+	}
+
+	replies, err := auditQuery(ff[1:])
+	if err != nil {
+		replies = []string{fmt.Sprintf("ERROR %v", err)}
+	}
+	for _, reply := range replies {
+		if _, err := tgsendMessage(reply, m.Chat.Id, "", m.MessageId); err != nil {
+			log("tgsendMessage: %v", err)
+			break
+		}
+	}
+	return true
+}
+
+func auditQuery(args []string) ([]string, error) {
+	count := 20
+	if len(args) == 1 || len(args) == 3 {
+		n, err := strconv.Atoi(args[len(args)-1])
+		if err != nil || n < 1 || n > 100 {
+			return nil, fmt.Errorf("count should be from 1 to 100")
+		}
+		count = n
+		args = args[:len(args)-1]
+	}
+
+	match := func(e AuditEntry) bool { return true }
+	if len(args) == 2 {
+		key, value := args[0], args[1]
+		switch key {
+		case "user":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				// the username is matched if it is not an id
+				username := strings.TrimPrefix(value, "@")
+				match = func(e AuditEntry) bool { return strings.EqualFold(e.Username, username) }
+				break
+			}
+			match = func(e AuditEntry) bool { return e.UserId == id }
+		case "chat":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid chat id %s", value)
+			}
+			match = func(e AuditEntry) bool { return e.ChatId == id }
+		case "video":
+			if mm := Config().YtReRegexp.FindStringSubmatch(value); len(mm) > 1 {
+				value = mm[1]
+			}
+			match = func(e AuditEntry) bool {
+				for _, id := range e.VideoIds {
+					if id == value {
+						return true
+					}
+				}
+				return false
+			}
+		default:
+			return nil, fmt.Errorf("usage: /audit [user|chat|video <id>] [<count>]")
+		}
+	} else if len(args) != 0 {
+		return nil, fmt.Errorf("usage: /audit [user|chat|video <id>] [<count>]")
+	}
+
+	ee, err := auditRecent()
+	if err != nil {
+		return nil, fmt.Errorf("auditRecent: %w", err)
+	}
+
+	var lines []string
+	for i := len(ee) - 1; i >= 0 && len(lines) < count; i-- {
+		if match(ee[i]) {
+			lines = append(lines, ee[i].String())
+		}
+	}
+	if len(lines) == 0 {
+		return []string{"no audit entries found"}, nil
+	}
+	return tgtextBatches(lines), nil
+}
+
+func (e AuditEntry) String() string {
+	s := fmt.Sprintf("%s user:%d", e.Time.UTC().Format("2006-01-02 15:04:05"), e.UserId)
+	if e.Username != "" {
+		s += fmt.Sprintf(" @%s", e.Username)
+	}
+	s += fmt.Sprintf(" chat:%d %s %s", e.ChatId, e.Command, e.Outcome)
+	if e.Class != "" {
+		s += " " + string(e.Class)
+	}
+	if len(e.VideoIds) > 0 {
+		s += " youtu.be/" + strings.Join(e.VideoIds, " youtu.be/")
+	}
+	if e.Format != "" {
+		s += " " + e.Format
+	}
+	if e.Bytes > 0 {
+		s += fmt.Sprintf(" %dmb", e.Bytes>>20)
+	}
+	if e.Elapsed > 0 {
+		s += fmt.Sprintf(" in %v", e.Elapsed.Truncate(time.Second))
+	}
+	if e.Details != "" {
+		s += NL + e.Details
+	}
+	return s
+}
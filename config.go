@@ -0,0 +1,494 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/exp/slices"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Config returns the current config, it is swapped as a whole on reload so callers should not keep it for long
+func Config() *TgZeConfig {
+	return ConfigPtr.Load()
+}
+
+// Check sets the defaults, validates the config and compiles the regexps
+func (config *TgZeConfig) Check() error {
+	config.SetDefaults()
+	return config.Validate()
+}
+
+func (config *TgZeConfig) SetDefaults() {
+	if config.LogFormat == "" {
+		config.LogFormat = LogFormatCompact
+	}
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+	}
+	if config.TgApiUrlBase == "" {
+		config.TgApiUrlBase = TgApiCloudUrlBase
+	}
+	// the urls are compared for the migration and joined with the methods paths
+	config.TgApiUrlBase = strings.TrimSuffix(config.TgApiUrlBase, "/")
+	if config.TgApiLocalMaxFileSizeBytes == 0 {
+		config.TgApiLocalMaxFileSizeBytes = 2000 << 20
+	}
+	if config.TgAccessMode == "" {
+		config.TgAccessMode = TgAccessOpen
+	}
+	if config.HttpListenAddr == "" {
+		config.HttpListenAddr = ":8080"
+	}
+	if config.HealthHeartbeatMaxAge == 0 {
+		config.HealthHeartbeatMaxAge = 10 * time.Minute
+	}
+	if config.TgGetUpdatesBackoffMax == 0 {
+		config.TgGetUpdatesBackoffMax = 5 * time.Minute
+	}
+	if config.TgChatAdminsCacheTtl == 0 {
+		config.TgChatAdminsCacheTtl = 10 * time.Minute
+	}
+	if config.JobRetries == 0 {
+		config.JobRetries = 2
+	}
+	if config.YtRetries == 0 {
+		config.YtRetries = 3
+	}
+	if config.RetryBackoffMin == 0 {
+		config.RetryBackoffMin = 2 * time.Second
+	}
+	if config.RetryBackoffMax == 0 {
+		config.RetryBackoffMax = time.Minute
+	}
+	if config.WorkDir == "" {
+		config.WorkDir = "work"
+	}
+	if config.WorkDirMinFreeBytes == 0 {
+		config.WorkDirMinFreeBytes = 100 << 20
+	}
+	if config.YtChunkSizeBytes == 0 {
+		config.YtChunkSizeBytes = 10 << 20
+	}
+	if config.AuditStateMaxSize == 0 {
+		config.AuditStateMaxSize = 1000
+	}
+	if config.AuditStateFlushInterval == 0 {
+		config.AuditStateFlushInterval = time.Minute
+	}
+	if config.TgUpdateLogMaxSize == 0 {
+		config.TgUpdateLogMaxSize = 1080
+	}
+	if config.TgPostedVideosMaxSize == 0 {
+		config.TgPostedVideosMaxSize = 1000
+	}
+	if config.TgProgressInterval == 0 {
+		config.TgProgressInterval = 3 * time.Second
+	}
+	if config.TgMaxFileSizeBytes == 0 {
+		config.TgMaxFileSizeBytes = 47 << 20
+	}
+	if config.TgAudioBitrateKbps == 0 {
+		config.TgAudioBitrateKbps = 60
+	}
+	if config.FfmpegOverheadPercent == 0 {
+		config.FfmpegOverheadPercent = 3
+	}
+	if config.FfmpegSizeRetries == 0 {
+		config.FfmpegSizeRetries = 2
+	}
+	if config.FfmpegPipelineUploadMarginPercent == 0 {
+		config.FfmpegPipelineUploadMarginPercent = 10
+	}
+	if config.FfmpegMinBitsPerPixel == 0 {
+		config.FfmpegMinBitsPerPixel = 0.05
+	}
+	if config.FfmpegGlobalOptions == nil {
+		config.FfmpegGlobalOptions = []string{"-v", "error"}
+	}
+	if config.YtMaxResults == 0 {
+		config.YtMaxResults = 50
+	}
+	if config.YtListConfirmSize == 0 {
+		config.YtListConfirmSize = 10
+	}
+	if config.YtListConfirmTimeout == 0 {
+		config.YtListConfirmTimeout = 10 * time.Minute
+	}
+	if config.YtHttpClientUserAgent == "" {
+		config.YtHttpClientUserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.2 Safari/605.1.15"
+	}
+	if config.YtRe == "" {
+		config.YtRe = `(?:youtube.com/watch\?v=|youtu.be/|youtube.com/shorts/|youtube.com/live/)([0-9A-Za-z_-]+)`
+	}
+	if config.YtListRe == "" {
+		config.YtListRe = `youtube.com/playlist\?list=([0-9A-Za-z_-]+)`
+	}
+	if config.YtDownloadLanguages == nil {
+		config.YtDownloadLanguages = []string{"english", "german", "russian", "ukrainian"}
+	}
+}
+
+// Validate checks all the fields and returns all the problems found, it also compiles the regexps
+func (config *TgZeConfig) Validate() error {
+	var errs []error
+
+	if config.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("Interval should be positive"))
+	}
+
+	if config.LogFormat != LogFormatCompact && config.LogFormat != LogFormatText && config.LogFormat != LogFormatJson {
+		errs = append(errs, fmt.Errorf("LogFormat `%s` should be %s %s or %s", config.LogFormat, LogFormatCompact, LogFormatText, LogFormatJson))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("LogLevel `%s` should be debug info warn or error", config.LogLevel))
+	}
+
+	if u, err := url.Parse(config.TgApiUrlBase); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("TgApiUrlBase `%s` should be an url like %s", config.TgApiUrlBase, TgApiCloudUrlBase))
+	}
+	if config.TgApiLocalMaxFileSizeBytes < 0 {
+		errs = append(errs, fmt.Errorf("TgApiLocalMaxFileSizeBytes should not be negative"))
+	}
+
+	if config.TgToken == "" {
+		errs = append(errs, fmt.Errorf("TgToken empty"))
+	}
+	if config.TgUpdateLogMaxSize < 1 {
+		errs = append(errs, fmt.Errorf("TgUpdateLogMaxSize should be positive"))
+	}
+
+	if config.TgAccessMode != TgAccessOpen && config.TgAccessMode != TgAccessAllowlist {
+		errs = append(errs, fmt.Errorf("TgAccessMode `%s` should be %s or %s", config.TgAccessMode, TgAccessOpen, TgAccessAllowlist))
+	}
+
+	for name, q := range map[string]TgQuota{"TgQuotaUser": config.TgQuotaUser, "TgQuotaChat": config.TgQuotaChat} {
+		if err := q.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	for chatid, q := range config.TgQuotaChats {
+		if err := q.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("TgQuotaChats %d: %w", chatid, err))
+		}
+	}
+
+	if config.HealthHeartbeatMaxAge < 0 || config.TgGetUpdatesBackoffMax < 0 {
+		errs = append(errs, fmt.Errorf("HealthHeartbeatMaxAge and TgGetUpdatesBackoffMax should not be negative"))
+	} else if config.TgGetUpdatesBackoff && config.HealthHeartbeatMaxAge <= config.TgGetUpdatesBackoffMax {
+		errs = append(errs, fmt.Errorf("HealthHeartbeatMaxAge should be longer than TgGetUpdatesBackoffMax"))
+	}
+
+	if config.TgDigestTime != "" {
+		if _, err := time.Parse("15:04", config.TgDigestTime); err != nil {
+			errs = append(errs, fmt.Errorf("TgDigestTime `%s` should be like 09:00", config.TgDigestTime))
+		}
+	}
+
+	for _, f := range config.TgReportFilters {
+		if !slices.Contains(TgReportFilterNames, f) {
+			errs = append(errs, fmt.Errorf("TgReportFilters `%s` should be one of %s", f, strings.Join(TgReportFilterNames, " ")))
+		}
+	}
+	if config.TgReportBatchInterval < 0 || config.TgChatAdminsCacheTtl < 0 {
+		errs = append(errs, fmt.Errorf("TgReportBatchInterval and TgChatAdminsCacheTtl should not be negative"))
+	}
+
+	if config.RetryBackoffMin < 0 || config.RetryBackoffMax < config.RetryBackoffMin {
+		errs = append(errs, fmt.Errorf("RetryBackoffMin should not be negative and not more than RetryBackoffMax"))
+	}
+	if config.FfmpegOverheadPercent >= 50 {
+		errs = append(errs, fmt.Errorf("FfmpegOverheadPercent should be less than 50"))
+	}
+	if config.FfmpegPipelineUploadMarginPercent < 0 || config.FfmpegPipelineUploadMarginPercent >= 50 {
+		errs = append(errs, fmt.Errorf("FfmpegPipelineUploadMarginPercent should be from 0 to 50"))
+	}
+	if config.FfmpegMinBitsPerPixel < 0 {
+		errs = append(errs, fmt.Errorf("FfmpegMinBitsPerPixel should not be negative"))
+	}
+
+	if config.WorkDirMinFreeBytes < 0 {
+		errs = append(errs, fmt.Errorf("WorkDirMinFreeBytes should not be negative"))
+	}
+	if config.YtChunkSizeBytes < 1<<20 {
+		errs = append(errs, fmt.Errorf("YtChunkSizeBytes should be at least 1mb"))
+	}
+
+	if config.AuditStateMaxSize < 1 {
+		errs = append(errs, fmt.Errorf("AuditStateMaxSize should be positive"))
+	}
+	if config.AuditStateFlushInterval < time.Second {
+		errs = append(errs, fmt.Errorf("AuditStateFlushInterval should be at least 1s"))
+	}
+
+	if config.TgCommandChannels == "" {
+		errs = append(errs, fmt.Errorf("TgCommandChannels empty"))
+	}
+	if config.TgCommandChannelsPromoteAdmin == "" {
+		errs = append(errs, fmt.Errorf("TgCommandChannelsPromoteAdmin empty"))
+	}
+
+	if config.TgPostedVideosMaxSize < 1 {
+		errs = append(errs, fmt.Errorf("TgPostedVideosMaxSize should be positive"))
+	}
+	if config.TgProgressInterval < 0 {
+		errs = append(errs, fmt.Errorf("TgProgressInterval should not be negative"))
+	}
+	if config.TgMaxFileSizeBytes < 1 {
+		errs = append(errs, fmt.Errorf("TgMaxFileSizeBytes should be positive"))
+	}
+	if config.TgAudioBitrateKbps < 1 {
+		errs = append(errs, fmt.Errorf("TgAudioBitrateKbps should be positive"))
+	}
+
+	if config.YtKey == "" {
+		errs = append(errs, fmt.Errorf("YtKey empty"))
+	}
+	if config.YtMaxResults < 1 || config.YtMaxResults > 50 {
+		// https://developers.google.com/youtube/v3/docs/playlistItems/list#maxResults
+		errs = append(errs, fmt.Errorf("YtMaxResults should be from 1 to 50"))
+	}
+
+	if config.YtListConfirmTimeout < time.Minute {
+		errs = append(errs, fmt.Errorf("YtListConfirmTimeout should be at least 1m"))
+	}
+
+	var err error
+	config.YtReRegexp, err = regexp.Compile(config.YtRe)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Compile YtRe `%s`: %w", config.YtRe, err))
+	} else if config.YtReRegexp.NumSubexp() < 1 {
+		errs = append(errs, fmt.Errorf("YtRe `%s` should have a group for the video id", config.YtRe))
+	}
+	config.YtListReRegexp, err = regexp.Compile(config.YtListRe)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Compile YtListRe `%s`: %w", config.YtListRe, err))
+	} else if config.YtListReRegexp.NumSubexp() < 1 {
+		errs = append(errs, fmt.Errorf("YtListRe `%s` should have a group for the playlist id", config.YtListRe))
+	}
+
+	if config.ConfigReloadInterval < 0 {
+		errs = append(errs, fmt.Errorf("ConfigReloadInterval should not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config safe to print or log
+func (config *TgZeConfig) Redacted() *TgZeConfig {
+	c := *config
+	for _, s := range []*string{
+		&c.TgToken, &c.YtKey,
+		&c.TgCommandChannels, &c.TgCommandChannelsPromoteAdmin,
+		&c.TgQuest1Key, &c.TgQuest2Key, &c.TgQuest3Key,
+	} {
+		if *s != "" {
+			*s = "<redacted>"
+		}
+	}
+	return &c
+}
+
+// configCommand runs `tgze config check [url]`, the url is file://, http://, https:// or a plain file path
+func configCommand(args []string) int {
+	if len(args) < 1 || args[0] != "check" {
+		fmt.Fprintf(os.Stderr, "usage: %s config check [url]"+NL, os.Args[0])
+		return 2
+	}
+
+	configurl := os.Getenv("YssUrl")
+	if v := os.Getenv("ConfigUrl"); v != "" {
+		configurl = v
+	}
+	if len(args) > 1 {
+		configurl = args[1]
+	}
+	if configurl == "" {
+		fmt.Fprintf(os.Stderr, "ERROR no config url in the arguments or ConfigUrl env"+NL)
+		return 2
+	}
+	if !strings.Contains(configurl, "://") {
+		configurl = "file://" + configurl
+	}
+
+	config := &TgZeConfig{ConfigUrl: configurl}
+	var err error
+	config.Store, err = NewStore(configurl)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR NewStore: %v"+NL, err)
+		return 1
+	}
+	if err := config.Get(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR Config.Get: %v"+NL, err)
+		return 1
+	}
+
+	config.SetDefaults()
+	verr := config.Validate()
+
+	rbb, err := yaml.Marshal(config.Redacted())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR yaml.Marshal: %v"+NL, err)
+		return 1
+	}
+	fmt.Printf("%s", rbb)
+
+	if verr != nil {
+		for _, e := range strings.Split(verr.Error(), NL) {
+			fmt.Fprintf(os.Stderr, "ERROR %s"+NL, e)
+		}
+		return 1
+	}
+
+	return 0
+}
+
+// GetSecrets overrides the secrets of the config document with the env vars like TgToken
+// or the files named by the env vars like TgTokenFile, for kubernetes secrets mounted as files
+func (config *TgZeConfig) GetSecrets() error {
+	for name, s := range map[string]*string{
+		"TgToken": &config.TgToken,
+		"YtKey":   &config.YtKey,
+	} {
+		if v := os.Getenv(name); v != "" {
+			*s = v
+			continue
+		}
+		if path := os.Getenv(name + "File"); path != "" {
+			v, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("%sFile: %w", name, err)
+			}
+			*s = strings.TrimSpace(string(v))
+		}
+	}
+	return nil
+}
+
+// redact hides the secrets of the current config in the text of logs and messages
+func redact(text string) string {
+	config := Config()
+	if config == nil {
+		return text
+	}
+	var oldnew []string
+	for _, secret := range []string{config.TgToken, config.YtKey} {
+		if len(secret) < 4 {
+			continue
+		}
+		oldnew = append(oldnew, secret, "<redacted>")
+		if escaped := url.QueryEscape(secret); escaped != secret {
+			oldnew = append(oldnew, escaped, "<redacted>")
+		}
+	}
+	if len(oldnew) == 0 {
+		return text
+	}
+	return strings.NewReplacer(oldnew...).Replace(text)
+}
+
+// configDiff returns the names of the yaml fields with different values
+func configDiff(a, b *TgZeConfig) (fields []string) {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		f := va.Type().Field(i)
+		if tag := f.Tag.Get("yaml"); tag == "" || tag == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			fields = append(fields, f.Name)
+		}
+	}
+	return fields
+}
+
+// these need a restart, the bot has to log out and in again to change the api server and the http server listens once
+var configRestartFields = []string{"TgApiUrlBase", "TgApiLocal", "TgApiMigrateFromUrlBase", "HttpListenAddr", "WorkDir"}
+
+// ConfigReloadRestartFields are the restart fields changed in the config document and reported already
+var ConfigReloadRestartFields string
+
+func configReload() error {
+	oldconfig := Config()
+
+	config := &TgZeConfig{ConfigUrl: oldconfig.ConfigUrl, Store: oldconfig.Store}
+	if err := config.Get(); err != nil {
+		return fmt.Errorf("Config.Get: %w", err)
+	}
+	if err := config.Check(); err != nil {
+		return fmt.Errorf("Config.Check: %w", err)
+	}
+
+	var ignored []string
+	for _, name := range configRestartFields {
+		fnew, fold := reflect.ValueOf(config).Elem().FieldByName(name), reflect.ValueOf(oldconfig).Elem().FieldByName(name)
+		if !reflect.DeepEqual(fnew.Interface(), fold.Interface()) {
+			ignored = append(ignored, name)
+			fnew.Set(fold)
+		}
+	}
+
+	// the restart fields differ on every reload until the restart so the same ones are reported once
+	if restart := strings.Join(ignored, " "); restart == ConfigReloadRestartFields {
+		ignored = nil
+	} else {
+		ConfigReloadRestartFields = restart
+	}
+
+	changed := configDiff(oldconfig, config)
+	if len(changed) == 0 && len(ignored) == 0 {
+		return nil
+	}
+
+	var reports []string
+	if len(changed) > 0 {
+		ConfigPtr.Store(config)
+		logInit()
+		reports = append(reports, fmt.Sprintf("config reloaded, changed: %s", strings.Join(changed, " ")))
+	}
+	if len(ignored) > 0 {
+		reports = append(reports, fmt.Sprintf("config changed: %s, ignored until restart", strings.Join(ignored, " ")))
+	}
+	report := strings.Join(reports, NL)
+	log("%s", report)
+	if config.ConfigReloadReport && config.TgZeChatId != 0 {
+		if _, err := tgsendMessage(report, config.TgZeChatId, "", 0); err != nil {
+			log("tgsendMessage: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// configReloader reloads the config on SIGHUP and every ConfigReloadInterval if it is set
+func configReloader() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	for {
+		var tick <-chan time.Time
+		if interval := Config().ConfigReloadInterval; interval > 0 {
+			tick = time.After(interval)
+		}
+
+		select {
+		case <-sighup:
+			log("sighup received, reloading the config")
+		case <-tick:
+		}
+
+		if err := configReload(); err != nil {
+			log("ERROR configReload: %v", err)
+		}
+	}
+}
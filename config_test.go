@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfigDefaults is a valid config with the change made before the defaults are set like in the config file
+func testConfigDefaults(t *testing.T, change func(config *TgZeConfig)) *TgZeConfig {
+	t.Helper()
+	config := &TgZeConfig{
+		Interval:                      time.Minute,
+		TgToken:                       "123:abc",
+		TgCommandChannels:             "/channels",
+		TgCommandChannelsPromoteAdmin: "/promote",
+		YtKey:                         "key",
+	}
+	change(config)
+	config.SetDefaults()
+	if err := config.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	return config
+}
+
+func TestConfigRetriesDisabled(t *testing.T) {
+	// zero gets the default and a negative value disables the retries
+	for _, tt := range []struct {
+		name  string
+		field func(config *TgZeConfig) *int
+		def   int
+	}{
+		{"JobRetries", func(config *TgZeConfig) *int { return &config.JobRetries }, 2},
+		{"YtRetries", func(config *TgZeConfig) *int { return &config.YtRetries }, 3},
+		{"FfmpegSizeRetries", func(config *TgZeConfig) *int { return &config.FfmpegSizeRetries }, 2},
+	} {
+		for value, want := range map[int]int{0: tt.def, 1: 1, -1: -1} {
+			config := testConfigDefaults(t, func(config *TgZeConfig) { *tt.field(config) = value })
+			if got := *tt.field(config); got != want {
+				t.Errorf("%s:%d after SetDefaults = %d, want %d", tt.name, value, got, want)
+			}
+		}
+	}
+}
+
+func TestConfigFfmpegOverheadPercent(t *testing.T) {
+	// zero gets the default and a negative value leaves no overhead
+	for value, want := range map[int64]int64{0: 3, 5: 5, -1: -1} {
+		config := testConfigDefaults(t, func(config *TgZeConfig) { config.FfmpegOverheadPercent = value })
+		if config.FfmpegOverheadPercent != want {
+			t.Errorf("FfmpegOverheadPercent:%d after SetDefaults = %d, want %d", value, config.FfmpegOverheadPercent, want)
+		}
+	}
+
+	config := &TgZeConfig{FfmpegOverheadPercent: 50}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "FfmpegOverheadPercent") {
+		t.Errorf("Validate FfmpegOverheadPercent:50 = %v, want the error", err)
+	}
+}
+
+func TestConfigTgApiUrlBase(t *testing.T) {
+	for value, want := range map[string]string{
+		"":                          TgApiCloudUrlBase,
+		"https://api.telegram.org/": TgApiCloudUrlBase,
+		"http://tgapi:8081":         "http://tgapi:8081",
+		"http://tgapi:8081/":        "http://tgapi:8081",
+	} {
+		config := testConfigDefaults(t, func(config *TgZeConfig) { config.TgApiUrlBase = value })
+		if config.TgApiUrlBase != want {
+			t.Errorf("TgApiUrlBase:%q after SetDefaults = %q, want %q", value, config.TgApiUrlBase, want)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	testConfig(t, func(config *TgZeConfig) {
+		config.TgToken = "123456:AAbb-cc_dd"
+		config.YtKey = "yt+key/secret"
+	})
+	for text, want := range map[string]string{
+		"https://api.telegram.org/bot123456:AAbb-cc_dd/getUpdates?offset=1":                             "https://api.telegram.org/bot<redacted>/getUpdates?offset=1",
+		`Get "https://api.telegram.org/bot123456:AAbb-cc_dd/sendMessage": dial tcp: connection refused`: `Get "https://api.telegram.org/bot<redacted>/sendMessage": dial tcp: connection refused`,
+		"https://www.googleapis.com/youtube/v3/videos?id=x&key=yt%2Bkey%2Fsecret":                       "https://www.googleapis.com/youtube/v3/videos?id=x&key=<redacted>",
+		"the key yt+key/secret is wrong":                                                                "the key <redacted> is wrong",
+		"nothing secret here":                                                                           "nothing secret here",
+	} {
+		if got := redact(text); got != want {
+			t.Errorf("redact(%q) = %q, want %q", text, got, want)
+		}
+	}
+
+	// short values like a test token are not replaced everywhere
+	testConfig(t, func(config *TgZeConfig) { config.TgToken = "x" })
+	if got := redact("max"); got != "max" {
+		t.Errorf("redact with a short token = %q, want %q", got, "max")
+	}
+}
+
+func TestGetSecrets(t *testing.T) {
+	dir := t.TempDir()
+	tokenfile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenfile, []byte("file:token"+NL), 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	for _, tt := range []struct {
+		name             string
+		token, tokenfile string
+		want             string
+		ok               bool
+	}{
+		{"the config value", "", "", "config:token", true},
+		{"the env var", "env:token", "", "env:token", true},
+		{"the file", "", tokenfile, "file:token", true},
+		{"the env var over the file", "env:token", tokenfile, "env:token", true},
+		{"a missing file", "", filepath.Join(dir, "missing"), "", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TgToken", tt.token)
+			t.Setenv("TgTokenFile", tt.tokenfile)
+			t.Setenv("YtKey", "")
+			t.Setenv("YtKeyFile", "")
+			config := &TgZeConfig{TgToken: "config:token", YtKey: "config:key"}
+			err := config.GetSecrets()
+			if (err == nil) != tt.ok {
+				t.Fatalf("GetSecrets = %v, want ok:%v", err, tt.ok)
+			}
+			if tt.ok && (config.TgToken != tt.want || config.YtKey != "config:key") {
+				t.Errorf("TgToken = %q YtKey = %q, want %q and the config key", config.TgToken, config.YtKey, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigReloadRestartFields(t *testing.T) {
+	for _, name := range []string{"TgToken", "TgTokenFile", "YtKey", "YtKeyFile"} {
+		t.Setenv(name, "")
+	}
+	const doc = "Interval: 1m\nTgToken: 123:abc\nTgCommandChannels: /channels\nTgCommandChannelsPromoteAdmin: /promote\nYtKey: key\n"
+	store := NewMemStore(t.Name())
+	put := func(doc string) {
+		t.Helper()
+		if _, err := store.Put([]byte(doc), ""); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	put(doc)
+
+	config := &TgZeConfig{Store: store}
+	if err := config.Get(); err != nil {
+		t.Fatalf("Config.Get: %v", err)
+	}
+	if err := config.Check(); err != nil {
+		t.Fatalf("Config.Check: %v", err)
+	}
+	old := ConfigPtr.Load()
+	ConfigPtr.Store(config)
+	t.Cleanup(func() {
+		ConfigPtr.Store(old)
+		ConfigReloadRestartFields = ""
+	})
+
+	// a change of the restart fields only keeps the config
+	put(doc + "HttpListenAddr: :9999\n")
+	for range 2 {
+		if err := configReload(); err != nil {
+			t.Fatalf("configReload: %v", err)
+		}
+		if Config() != config {
+			t.Errorf("the config is replaced for a change of the restart fields")
+		}
+		if ConfigReloadRestartFields != "HttpListenAddr" {
+			t.Errorf("ConfigReloadRestartFields = %q, want HttpListenAddr", ConfigReloadRestartFields)
+		}
+	}
+
+	put(doc + "HttpListenAddr: :9999\nJobRetries: 5\n")
+	if err := configReload(); err != nil {
+		t.Fatalf("configReload: %v", err)
+	}
+	if Config().JobRetries != 5 || Config().HttpListenAddr != config.HttpListenAddr {
+		t.Errorf("JobRetries = %d HttpListenAddr = %s after the reload, want 5 and %s", Config().JobRetries, Config().HttpListenAddr, config.HttpListenAddr)
+	}
+}
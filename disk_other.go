@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+)
+
+// diskFree is not supported here so the free space is not checked
+func diskFree(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"syscall"
+)
+
+// diskFree is the space available to the process on the filesystem of the path
+func diskFree(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	ytdl "github.com/kkdai/youtube/v2"
+)
+
+// FfmpegTarget is the bitrates and the size of the transcoded output
+type FfmpegTarget struct {
+	VideoBitrateKbps int64
+	AudioBitrateKbps int64
+	// Height scales the video down keeping the aspect ratio, zero keeps the size of the source
+	Height int
+	// TwoPass encodes the video in two passes so the average bitrate is close to the target, it needs the input file
+	TwoPass bool
+}
+
+func (t FfmpegTarget) String() string {
+	if t.VideoBitrateKbps == 0 {
+		return fmt.Sprintf("audio:%dkbps", t.AudioBitrateKbps)
+	}
+	s := fmt.Sprintf("video:%dkbps", t.VideoBitrateKbps)
+	if t.Height > 0 {
+		s += fmt.Sprintf(" %dp", t.Height)
+	}
+	return s + fmt.Sprintf(" audio:%dkbps", t.AudioBitrateKbps)
+}
+
+var FfmpegScaleHeights = []int{2160, 1440, 1080, 720, 480, 360, 240, 144}
+
+// ffmpegSizeKbps is the total bitrate that fits the size with FfmpegOverheadPercent left for the container
+func ffmpegSizeKbps(size int64, duration time.Duration) int64 {
+	size = size * (100 - max(0, Config().FfmpegOverheadPercent)) / 100
+	return size * 8 / int64(duration.Seconds()+1) / 1024
+}
+
+// ffmpegTargetVideo is the target for the video to fit the size together with the audio
+func ffmpegTargetVideo(size int64, duration time.Duration, f ytdl.Format) FfmpegTarget {
+	config := Config()
+	t := FfmpegTarget{
+		AudioBitrateKbps: config.TgAudioBitrateKbps,
+		TwoPass:          config.FfmpegTwoPass,
+	}
+	t.VideoBitrateKbps = ffmpegSizeKbps(size, duration) - t.AudioBitrateKbps
+	t.Height = ffmpegScaleHeight(t.VideoBitrateKbps, f)
+	return t
+}
+
+// ffmpegTargetAudio is the target for the audio to fit the size
+func ffmpegTargetAudio(size int64, duration time.Duration) FfmpegTarget {
+	return FfmpegTarget{AudioBitrateKbps: ffmpegSizeKbps(size, duration)}
+}
+
+// ffmpegScaleHeight is the biggest height lower than the source where the video bitrate gives at least
+// FfmpegMinBitsPerPixel for every pixel of every frame, zero if the bitrate is enough for the source height
+func ffmpegScaleHeight(videoBitrateKbps int64, f ytdl.Format) int {
+	if f.Width == 0 || f.Height == 0 {
+		return 0
+	}
+	fps := f.FPS
+	if fps == 0 {
+		fps = 30
+	}
+	enough := func(height int) bool {
+		width := f.Width * height / f.Height
+		return float64(videoBitrateKbps*1024)/float64(width*height*fps) >= Config().FfmpegMinBitsPerPixel
+	}
+	if enough(f.Height) {
+		return 0
+	}
+	for _, h := range FfmpegScaleHeights {
+		if h < f.Height && enough(h) {
+			return h
+		}
+	}
+	return FfmpegScaleHeights[len(FfmpegScaleHeights)-1]
+}
+
+// ffmpegScaleSize is the width and the height of the video after the scaling of the target
+func ffmpegScaleSize(t FfmpegTarget, f ytdl.Format) (width, height int) {
+	if t.Height == 0 || f.Height == 0 {
+		return f.Width, f.Height
+	}
+	// scale=-2 rounds the width to an even number
+	return f.Width * t.Height / f.Height / 2 * 2, t.Height
+}
+
+// ffmpegTargetLower lowers the bitrates by how much the size of the output is over the telegram limit
+func ffmpegTargetLower(t FfmpegTarget, size int64, f ytdl.Format) FfmpegTarget {
+	// a bit lower than the ratio so the next output is not just over the limit again
+	ratio := float64(tgmaxfilesize()) / float64(size) * 0.95
+	if t.VideoBitrateKbps == 0 {
+		t.AudioBitrateKbps = int64(float64(t.AudioBitrateKbps) * ratio)
+		return t
+	}
+	t.VideoBitrateKbps = int64(float64(t.VideoBitrateKbps+t.AudioBitrateKbps)*ratio) - t.AudioBitrateKbps
+	t.Height = ffmpegScaleHeight(t.VideoBitrateKbps, f)
+	return t
+}
+
+// ffmpegFitSize checks the size of the transcoded file and while it is over the telegram limit encodes it again
+// at the lowered bitrates up to FfmpegSizeRetries times, from the source or without it from the transcoded file itself.
+// it returns the target of the last encoding
+func ffmpegFitSize(ctx context.Context, source, filename2 string, t FfmpegTarget, f ytdl.Format, duration time.Duration, progress *TgProgress) (FfmpegTarget, error) {
+	config, maxfilesize := Config(), tgmaxfilesize()
+	for attempt := 1; ; attempt++ {
+		fi, err := os.Stat(filename2)
+		if err != nil {
+			return t, fmt.Errorf("os.Stat: %w", err)
+		}
+		if fi.Size() <= maxfilesize {
+			return t, nil
+		}
+
+		lower := ffmpegTargetLower(t, fi.Size(), f)
+		if attempt > config.FfmpegSizeRetries || lower.AudioBitrateKbps < 8 || (t.VideoBitrateKbps > 0 && lower.VideoBitrateKbps < 32) {
+			return t, fmt.Errorf("transcoded size %dmb exceeds the telegram limit of %dmb: %w", fi.Size()>>20, maxfilesize>>20, ErrTooLarge)
+		}
+		logctx(ctx, "WARNING transcoded to %s size %dmb is over the limit of %dmb, transcoding to %s", t, fi.Size()>>20, maxfilesize>>20, lower)
+		t = lower
+
+		input := source
+		if input == "" {
+			input = filename2 + ".over"
+			if err := os.Rename(filename2, input); err != nil {
+				return t, fmt.Errorf("os.Rename: %w", err)
+			}
+		}
+		progress.Stage(fmt.Sprintf("transcoding again to %s", t), int64(duration.Seconds()), "%")
+		err = FfmpegTranscode(ctx, input, filename2, nil, nil, t, progress)
+		if source == "" {
+			removeFile(input)
+		}
+		if err != nil {
+			return t, err
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ytdl "github.com/kkdai/youtube/v2"
+)
+
+func TestFfmpegSizeKbps(t *testing.T) {
+	testConfig(t, nil)
+	// 47mb less 3% of the overhead in 601 seconds
+	if got := ffmpegSizeKbps(47<<20, 10*time.Minute); got != 621 {
+		t.Errorf("ffmpegSizeKbps = %d, want 621", got)
+	}
+
+	testConfig(t, func(config *TgZeConfig) { config.FfmpegOverheadPercent = -1 })
+	// the whole 47mb in 601 seconds
+	if got := ffmpegSizeKbps(47<<20, 10*time.Minute); got != 640 {
+		t.Errorf("ffmpegSizeKbps without the overhead = %d, want 640", got)
+	}
+}
+
+func TestFfmpegScaleHeight(t *testing.T) {
+	testConfig(t, nil)
+	hd := ytdl.Format{Width: 1920, Height: 1080, FPS: 30}
+	for _, tt := range []struct {
+		name string
+		kbps int64
+		f    ytdl.Format
+		want int
+	}{
+		{"enough for the source", 4000, hd, 0},
+		{"just enough for the source", 3038, hd, 0},
+		{"not enough for the source", 3037, hd, 720},
+		{"480p", 1000, hd, 480},
+		{"fps defaults to 30", 1000, ytdl.Format{Width: 1920, Height: 1080}, 480},
+		{"higher fps needs more", 1000, ytdl.Format{Width: 1920, Height: 1080, FPS: 60}, 360},
+		{"not lower than 144p", 10, hd, 144},
+		{"lower than the source only", 100, ytdl.Format{Width: 640, Height: 360, FPS: 30}, 144},
+		{"unknown size", 10, ytdl.Format{}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ffmpegScaleHeight(tt.kbps, tt.f); got != tt.want {
+				t.Errorf("ffmpegScaleHeight(%d, %dx%d@%d) = %d, want %d", tt.kbps, tt.f.Width, tt.f.Height, tt.f.FPS, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFfmpegScaleSize(t *testing.T) {
+	hd := ytdl.Format{Width: 1920, Height: 1080}
+	for _, tt := range []struct {
+		t             FfmpegTarget
+		f             ytdl.Format
+		width, height int
+	}{
+		{FfmpegTarget{}, hd, 1920, 1080},
+		{FfmpegTarget{Height: 720}, hd, 1280, 720},
+		// 853.33 is rounded down to an even width
+		{FfmpegTarget{Height: 480}, hd, 852, 480},
+		{FfmpegTarget{Height: 480}, ytdl.Format{}, 0, 0},
+	} {
+		if width, height := ffmpegScaleSize(tt.t, tt.f); width != tt.width || height != tt.height {
+			t.Errorf("ffmpegScaleSize(%v) = %dx%d, want %dx%d", tt.t, width, height, tt.width, tt.height)
+		}
+	}
+}
+
+func TestFfmpegTargetLower(t *testing.T) {
+	testConfig(t, nil)
+	limit := tgmaxfilesize()
+	hd := ytdl.Format{Width: 1920, Height: 1080, FPS: 30}
+	for _, tt := range []struct {
+		name string
+		t    FfmpegTarget
+		size int64
+		want FfmpegTarget
+	}{
+		{
+			"audio", FfmpegTarget{AudioBitrateKbps: 100}, 2 * limit,
+			FfmpegTarget{AudioBitrateKbps: 47},
+		},
+		{
+			// the total 1060kbps times 0.5 times 0.95 less the audio
+			"video", FfmpegTarget{VideoBitrateKbps: 1000, AudioBitrateKbps: 60}, 2 * limit,
+			FfmpegTarget{VideoBitrateKbps: 443, AudioBitrateKbps: 60, Height: 360},
+		},
+		{
+			"video keeps two pass", FfmpegTarget{VideoBitrateKbps: 4000, AudioBitrateKbps: 60, TwoPass: true}, limit + limit/10,
+			FfmpegTarget{VideoBitrateKbps: 3446, AudioBitrateKbps: 60, TwoPass: true},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ffmpegTargetLower(tt.t, tt.size, hd); got != tt.want {
+				t.Errorf("ffmpegTargetLower(%v, %dmb) = %+v, want %+v", tt.t, tt.size>>20, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	ytdl "github.com/kkdai/youtube/v2"
+)
+
+type ErrClass string
+
+const (
+	ErrClassCancelled     ErrClass = "cancelled"
+	ErrClassAgeRestricted ErrClass = "age-restricted"
+	ErrClassPrivate       ErrClass = "private"
+	ErrClassRemoved       ErrClass = "removed"
+	ErrClassRegionBlocked ErrClass = "region-blocked"
+	ErrClassLive          ErrClass = "live"
+	ErrClassNotPlayable   ErrClass = "not-playable"
+	ErrClassNoFormat      ErrClass = "no-format"
+	ErrClassTooLarge      ErrClass = "too-large"
+	ErrClassQuota         ErrClass = "quota"
+	ErrClassRateLimited   ErrClass = "rate-limited"
+	ErrClassTransient     ErrClass = "transient"
+	ErrClassTranscode     ErrClass = "transcode"
+	ErrClassNoSpace       ErrClass = "no-space"
+	ErrClassUnknown       ErrClass = "unknown"
+)
+
+var (
+	ErrTooLarge = errors.New("too large for telegram")
+	ErrNoFormat = errors.New("no suitable format found")
+	ErrQuota    = errors.New("quota")
+)
+
+// TranscodeError is the failure of the ffmpeg command itself, not of the download or the upload around it
+type TranscodeError struct {
+	Err error
+}
+
+func (e *TranscodeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TranscodeError) Unwrap() error {
+	return e.Err
+}
+
+// errclass tells what kind of failure the error is, from the ytdl errors, the http status codes and the texts of the errors
+func errclass(err error) ErrClass {
+	if err == nil {
+		return ""
+	}
+
+	var playability *ytdl.ErrPlayabiltyStatus
+	var statuscode ytdl.ErrUnexpectedStatusCode
+	var neterr net.Error
+	var dnserr *net.DNSError
+	var transcode *TranscodeError
+	s := strings.ToLower(err.Error())
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrClassCancelled
+	case errors.Is(err, ErrQuota):
+		return ErrClassQuota
+	case errors.Is(err, ErrTooLarge) || strings.Contains(s, "request entity too large") || strings.Contains(s, "file is too big"):
+		return ErrClassTooLarge
+	case errors.Is(err, ErrNoSpace) || errors.Is(err, syscall.ENOSPC):
+		return ErrClassNoSpace
+	case errors.Is(err, ErrNoFormat):
+		return ErrClassNoFormat
+	case errors.Is(err, ytdl.ErrLoginRequired):
+		return ErrClassAgeRestricted
+	case errors.Is(err, ytdl.ErrVideoPrivate):
+		return ErrClassPrivate
+	case errors.Is(err, ytdl.ErrNotPlayableInEmbed):
+		return ErrClassNotPlayable
+	case errors.As(err, &playability):
+		reason := strings.ToLower(playability.Reason)
+		switch {
+		case strings.Contains(reason, "country"):
+			return ErrClassRegionBlocked
+		case playability.Status == "LIVE_STREAM_OFFLINE" || strings.Contains(reason, "live") || strings.Contains(reason, "premiere"):
+			return ErrClassLive
+		case strings.Contains(reason, "private"):
+			return ErrClassPrivate
+		case strings.Contains(reason, "removed") || strings.Contains(reason, "unavailable") || strings.Contains(reason, "terminated") || playability.Status == "ERROR":
+			return ErrClassRemoved
+		}
+		return ErrClassNotPlayable
+	case errors.As(err, &statuscode):
+		switch {
+		case statuscode == 429 || statuscode == 403:
+			return ErrClassRateLimited
+		case statuscode >= 500:
+			return ErrClassTransient
+		case statuscode == 404 || statuscode == 410:
+			return ErrClassRemoved
+		}
+		return ErrClassUnknown
+	case strings.Contains(s, "too many requests"):
+		return ErrClassRateLimited
+	case errors.As(err, &transcode):
+		return ErrClassTranscode
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, syscall.EPIPE):
+		return ErrClassTransient
+	// other network errors like a bad certificate or an unknown host fail the same way again
+	case errors.As(err, &neterr) && neterr.Timeout(), errors.As(err, &dnserr) && (dnserr.IsTemporary || dnserr.IsTimeout):
+		return ErrClassTransient
+	case strings.Contains(s, "connection reset") || strings.Contains(s, "unexpected eof") || strings.Contains(s, "timeout") ||
+		strings.Contains(s, "bad gateway") || strings.Contains(s, "internal server error") || strings.Contains(s, "service unavailable"):
+		return ErrClassTransient
+	}
+	return ErrClassUnknown
+}
+
+// errretry reports if the same request may work if it is tried again a bit later
+func errretry(class ErrClass) bool {
+	return class == ErrClassTransient || class == ErrClassRateLimited
+}
+
+// errmessage is the reply to the user for the failure of a job of the kind audio video or raw, the raw error is only logged
+func errmessage(class ErrClass, err error, kind string) string {
+	switch class {
+	case ErrClassCancelled:
+		return "cancelled"
+	case ErrClassAgeRestricted:
+		return "the video is age-restricted and cannot be downloaded without logging in"
+	case ErrClassPrivate:
+		return "the video is private"
+	case ErrClassRemoved:
+		return "the video is removed or unavailable"
+	case ErrClassRegionBlocked:
+		return "the video is not available in the country of the bot"
+	case ErrClassLive:
+		return "the live stream is not finished yet, please try again after it ends"
+	case ErrClassNotPlayable:
+		return "youtube does not allow to play this video outside of youtube"
+	case ErrClassNoFormat:
+		return "no suitable format found for this video"
+	case ErrClassTooLarge:
+		switch kind {
+		case "video":
+			return "the video is too large for telegram, try audio instead"
+		case "raw":
+			return "the original is too large for telegram, try video or audio instead"
+		}
+		return "the audio is too large for telegram even at the lowest bitrate"
+	case ErrClassQuota:
+		return strings.TrimPrefix(err.Error(), ErrQuota.Error()+": ")
+	case ErrClassRateLimited:
+		return "youtube or telegram is limiting the requests, please try again later"
+	case ErrClassTransient:
+		return "a network error happened, please try again later"
+	case ErrClassTranscode:
+		return "transcoding failed"
+	case ErrClassNoSpace:
+		return "the bot is out of disk space, please try again later"
+	}
+	return "the download failed"
+}
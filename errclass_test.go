@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	ytdl "github.com/kkdai/youtube/v2"
+)
+
+// timeoutError is a net.Error like the ones of the http client when a deadline is reached
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o deadline reached" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrclass(t *testing.T) {
+	urlerr := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://example.com", Err: err}
+	}
+	for _, tt := range []struct {
+		err  error
+		want ErrClass
+	}{
+		{nil, ""},
+		{context.Canceled, ErrClassCancelled},
+		{fmt.Errorf("post: %w", context.Canceled), ErrClassCancelled},
+		{fmt.Errorf("%w: the daily limit is used up", ErrQuota), ErrClassQuota},
+		{fmt.Errorf("ffmpegFitSize: %w", ErrTooLarge), ErrClassTooLarge},
+		{errors.New("sendVideo: Request Entity Too Large"), ErrClassTooLarge},
+		{fmt.Errorf("workdirCheck: %w", ErrNoSpace), ErrClassNoSpace},
+		{&os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}, ErrClassNoSpace},
+		{ErrNoFormat, ErrClassNoFormat},
+		{fmt.Errorf("GetVideoContext: %w", ytdl.ErrLoginRequired), ErrClassAgeRestricted},
+		{ytdl.ErrVideoPrivate, ErrClassPrivate},
+		{ytdl.ErrNotPlayableInEmbed, ErrClassNotPlayable},
+		{&ytdl.ErrPlayabiltyStatus{Status: "UNPLAYABLE", Reason: "The uploader has not made this video available in your country"}, ErrClassRegionBlocked},
+		{&ytdl.ErrPlayabiltyStatus{Status: "LIVE_STREAM_OFFLINE", Reason: ""}, ErrClassLive},
+		{&ytdl.ErrPlayabiltyStatus{Status: "ERROR", Reason: "Video unavailable"}, ErrClassRemoved},
+		{&ytdl.ErrPlayabiltyStatus{Status: "LOGIN_REQUIRED", Reason: "This video is private"}, ErrClassPrivate},
+		{&ytdl.ErrPlayabiltyStatus{Status: "UNPLAYABLE", Reason: "something else"}, ErrClassNotPlayable},
+		{ytdl.ErrUnexpectedStatusCode(429), ErrClassRateLimited},
+		{fmt.Errorf("GetStream: %w", ytdl.ErrUnexpectedStatusCode(403)), ErrClassRateLimited},
+		{ytdl.ErrUnexpectedStatusCode(503), ErrClassTransient},
+		{ytdl.ErrUnexpectedStatusCode(404), ErrClassRemoved},
+		{ytdl.ErrUnexpectedStatusCode(400), ErrClassUnknown},
+		{errors.New("Too Many Requests: retry after 5"), ErrClassRateLimited},
+		{&TranscodeError{Err: errors.New("ffmpeg Wait: exit status 1")}, ErrClassTranscode},
+		{fmt.Errorf("FfmpegFitSize: %w", &TranscodeError{Err: errors.New("ffmpeg Start: no such file")}), ErrClassTranscode},
+		{errors.New("ffmpeg: exit status 1"), ErrClassUnknown},
+		{fmt.Errorf("FfmpegPipeline: %w", fmt.Errorf("download: %w", io.ErrUnexpectedEOF)), ErrClassTransient},
+		{fmt.Errorf("ffmpegFitSize: FfmpegPipeline: %w", urlerr(&net.OpError{Op: "write", Net: "tcp", Err: syscall.ECONNRESET})), ErrClassTransient},
+		{context.DeadlineExceeded, ErrClassTransient},
+		{io.ErrUnexpectedEOF, ErrClassTransient},
+		{urlerr(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}), ErrClassTransient},
+		{urlerr(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), ErrClassTransient},
+		{urlerr(timeoutError{}), ErrClassTransient},
+		{urlerr(&net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}), ErrClassTransient},
+		{urlerr(&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}), ErrClassUnknown},
+		{urlerr(x509.UnknownAuthorityError{}), ErrClassUnknown},
+		{urlerr(errors.New("unsupported protocol scheme")), ErrClassUnknown},
+		{errors.New("502 Bad Gateway"), ErrClassTransient},
+		{&RetriedError{Err: ytdl.ErrUnexpectedStatusCode(503)}, ErrClassTransient},
+		{errors.New("something"), ErrClassUnknown},
+	} {
+		if got := errclass(tt.err); got != tt.want {
+			t.Errorf("errclass(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestErrretry(t *testing.T) {
+	for class, want := range map[ErrClass]bool{
+		ErrClassTransient:   true,
+		ErrClassRateLimited: true,
+		ErrClassTooLarge:    false,
+		ErrClassRemoved:     false,
+		ErrClassCancelled:   false,
+		ErrClassUnknown:     false,
+	} {
+		if got := errretry(class); got != want {
+			t.Errorf("errretry(%q) = %v, want %v", class, got, want)
+		}
+	}
+}
+
+func TestErrmessageQuota(t *testing.T) {
+	err := fmt.Errorf("%w: %w", ErrQuota, errors.New("the daily limit of 10 videos allows 0 more today"))
+	if got, want := errmessage(errclass(err), err, "audio"), "the daily limit of 10 videos allows 0 more today"; got != want {
+		t.Errorf("errmessage = %q, want %q", got, want)
+	}
+}
+
+func TestProgressReaderFailed(t *testing.T) {
+	// ffmpeg exits with an error after its input breaks and that is a download failure
+	pr := &ProgressReader{err: io.ErrUnexpectedEOF}
+	if got := errclass(pr.failed(&TranscodeError{Err: errors.New("ffmpeg Wait: exit status 1")})); got != ErrClassTransient {
+		t.Errorf("errclass of a broken input = %q, want %q", got, ErrClassTransient)
+	}
+	pr = &ProgressReader{}
+	if got := errclass(pr.failed(&TranscodeError{Err: errors.New("ffmpeg Wait: exit status 1")})); got != ErrClassTranscode {
+		t.Errorf("errclass of a whole input = %q, want %q", got, ErrClassTranscode)
+	}
+	if err := pr.failed(nil); err != nil {
+		t.Errorf("failed(nil) = %v, want nil", err)
+	}
+}
+
+func TestErrmessageTooLarge(t *testing.T) {
+	err := fmt.Errorf("ffmpegFitSize: %w", ErrTooLarge)
+	for kind, want := range map[string]string{
+		"audio": "the audio is too large for telegram even at the lowest bitrate",
+		"video": "the video is too large for telegram, try audio instead",
+		"raw":   "the original is too large for telegram, try video or audio instead",
+	} {
+		if got := errmessage(errclass(err), err, kind); got != want {
+			t.Errorf("errmessage for %s = %q, want %q", kind, got, want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Heartbeat is the time of the last main loop iteration in unix nanoseconds
+	Heartbeat atomic.Int64
+	// Started is set when the init is finished and the main loop starts
+	Started atomic.Bool
+
+	ReadyMutex   sync.Mutex
+	ReadyChecked time.Time
+	ReadyErr     error
+
+	TgGetUpdatesFailures int
+)
+
+// healthzHandler reports if the process is alive and the main loop is not stuck
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	age := time.Since(time.Unix(0, Heartbeat.Load()))
+	if age > Config().HealthHeartbeatMaxAge {
+		http.Error(w, fmt.Sprintf("main loop heartbeat %v ago", age.Truncate(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "ok"+NL)
+}
+
+// readyzHandler reports if the init is finished, telegram getMe works and ffmpeg is found,
+// the result is cached for a minute so the probes do not call telegram every time
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !Started.Load() {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+
+	ReadyMutex.Lock()
+	if time.Since(ReadyChecked) > time.Minute {
+		ReadyErr = ready()
+		ReadyChecked = time.Now()
+	}
+	err := ReadyErr
+	ReadyMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "ok"+NL)
+}
+
+func ready() error {
+	config := Config()
+	if config == nil {
+		return fmt.Errorf("config not loaded")
+	}
+	if err := tgcallMethod(config.TgApiUrlBase, "getMe"); err != nil {
+		return fmt.Errorf("getMe: %s", redact(err.Error()))
+	}
+	if config.FfmpegPath != "" {
+		if _, err := exec.LookPath(config.FfmpegPath); err != nil {
+			return fmt.Errorf("ffmpeg: %w", err)
+		}
+	}
+	return nil
+}
+
+// tggetUpdatesFailed exits unless TgGetUpdatesBackoff is set and the error is transient,
+// then it sleeps twice longer after every failure in a row up to TgGetUpdatesBackoffMax
+func tggetUpdatesFailed(err error) {
+	if !Config().TgGetUpdatesBackoff || !tgtransient(err) {
+		os.Exit(1)
+	}
+
+	TgGetUpdatesFailures++
+	backoff := Config().TgGetUpdatesBackoffMax
+	if n := TgGetUpdatesFailures - 1; n < 32 && Config().Interval<<n < backoff {
+		backoff = Config().Interval << n
+	}
+	log("WARNING tggetUpdates failures:%d backing off for %v", TgGetUpdatesFailures, backoff)
+	time.Sleep(backoff)
+}
+
+// tgtransient reports if the error may go away by itself, a wrong token does not
+func tgtransient(err error) bool {
+	for _, s := range []string{"Unauthorized", "Not Found"} {
+		if strings.Contains(err.Error(), s) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthDuringInit(t *testing.T) {
+	testConfig(t, nil)
+	Heartbeat.Store(time.Now().UnixNano())
+	Started.Store(false)
+	t.Cleanup(func() { Started.Store(false) })
+
+	w := httptest.NewRecorder()
+	healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("healthz during the init = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	w = httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz during the init = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+)
+
+// httpServe serves the metrics and the health checks on HttpListenAddr, a failure to listen is logged and the bot keeps working without it
+func httpServe() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	addr := Config().HttpListenAddr
+	log("http listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log("ERROR http.ListenAndServe %s: %v", addr, err)
+	}
+}
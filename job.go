@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ytdl "github.com/kkdai/youtube/v2"
+)
+
+type Job struct {
+	Id       int64
+	UpdateId int64
+
+	Ctx    context.Context
+	Cancel context.CancelFunc
+
+	Message     TgMessage
+	ChannelPost bool
+	Videos      []YtVideo
+	Video       bool
+	Raw         bool
+
+	Progress *TgProgress
+	Pending  bool
+
+	Ytdl *ytdl.Client
+	// Dir keeps the files of the job, it is removed when the job finishes
+	Dir string
+
+	Posted []YtVideo
+	Failed []JobFailure
+	// Bytes is the total size downloaded by the job, it is counted in the daily quota
+	Bytes int64
+	// Format is set by the post functions for the audit log
+	Format string
+}
+
+type JobFailure struct {
+	Video YtVideo
+	Class ErrClass
+	Err   error
+}
+
+var (
+	JobsMutex  sync.Mutex
+	Jobs       = map[int64]*Job{}
+	JobsLastId int64
+
+	JobsQueue = make(chan *Job, 1000)
+)
+
+func jobsAdd(job *Job) {
+	JobsMutex.Lock()
+	JobsLastId++
+	job.Id = JobsLastId
+	job.Ctx, job.Cancel = context.WithCancel(logWith(Ctx,
+		"update_id", job.UpdateId, "job_id", job.Id, "chat_id", job.Message.Chat.Id, "user_id", job.Message.From.Id,
+	))
+	Jobs[job.Id] = job
+	JobsMutex.Unlock()
+}
+
+func jobsEnqueue(job *Job) error {
+	jobsAdd(job)
+	job.Progress = tgnewProgress(job.Ctx, job.Message.Chat.Id, job.Message.MessageId, "queued", tgcancelMarkup(job.Id))
+	return jobsPush(job)
+}
+
+// jobsConfirm adds the job as pending, it is queued after the start button is pressed
+func jobsConfirm(job *Job) error {
+	job.Pending = true
+	jobsAdd(job)
+
+	var duration time.Duration
+	for _, v := range job.Videos {
+		duration += v.Duration
+	}
+	job.Progress = tgnewProgress(
+		job.Ctx,
+		job.Message.Chat.Id, job.Message.MessageId,
+		fmt.Sprintf("%d videos total duration %v"+NL+"start?", len(job.Videos), duration),
+		&TgInlineKeyboardMarkup{
+			InlineKeyboard: [][]TgInlineKeyboardButton{{
+				{Text: "start", CallbackData: fmt.Sprintf("start %d", job.Id)},
+				{Text: "cancel", CallbackData: fmt.Sprintf("cancel %d", job.Id)},
+			}},
+		},
+	)
+	if job.Progress == nil {
+		job.done()
+		return fmt.Errorf("could not send the confirmation message")
+	}
+
+	logctx(job.Ctx, "job pending confirmation videos:%d duration:%v", len(job.Videos), duration)
+
+	timeout := Config().YtListConfirmTimeout
+	time.AfterFunc(timeout, func() { jobsExpire(job, timeout) })
+
+	return nil
+}
+
+// jobsExpire cancels the job if it is still pending and edits the confirmation message to tell it was not started
+func jobsExpire(job *Job, timeout time.Duration) {
+	JobsMutex.Lock()
+	pending := job.Pending
+	job.Pending = false
+	JobsMutex.Unlock()
+	if !pending {
+		return
+	}
+
+	logctx(job.Ctx, "job pending confirmation expired after %v", timeout)
+	job.Cancel()
+	quotaRefund(job.Ctx, job.Message.From.Id, job.Message.Chat.Id)
+
+	// the message is kept without the buttons, so the job is not finished with done that deletes it
+	job.Progress.Markup = nil
+	job.Progress.Stage(fmt.Sprintf("%d videos not started in %v, cancelled", len(job.Videos), timeout), 0, "")
+	job.Progress.Close()
+	JobsMutex.Lock()
+	delete(Jobs, job.Id)
+	JobsMutex.Unlock()
+}
+
+func jobsStart(jobid, userid int64) error {
+	JobsMutex.Lock()
+	job := Jobs[jobid]
+	if job == nil || !job.Pending {
+		JobsMutex.Unlock()
+		return fmt.Errorf("the job is already started or finished")
+	}
+	JobsMutex.Unlock()
+
+	if err := job.allowed(userid); err != nil {
+		return err
+	}
+
+	JobsMutex.Lock()
+	if !job.Pending {
+		JobsMutex.Unlock()
+		return fmt.Errorf("the job is already started")
+	}
+	job.Pending = false
+	JobsMutex.Unlock()
+
+	job.Progress.Markup = tgcancelMarkup(job.Id)
+	job.Progress.Stage("queued", 0, "")
+
+	if err := jobsPush(job); err != nil {
+		quotaRefund(job.Ctx, job.Message.From.Id, job.Message.Chat.Id)
+		return err
+	}
+	return nil
+}
+
+func jobsPush(job *Job) error {
+	select {
+	case JobsQueue <- job:
+	default:
+		job.done()
+		return fmt.Errorf("the queue is full")
+	}
+
+	logctx(job.Ctx, "job queued videos:%d", len(job.Videos))
+
+	return nil
+}
+
+func jobsWorker() {
+	for job := range JobsQueue {
+		job.Run()
+		job.done()
+	}
+}
+
+func (job *Job) done() {
+	job.Cancel()
+	job.Progress.Delete()
+	JobsMutex.Lock()
+	delete(Jobs, job.Id)
+	JobsMutex.Unlock()
+}
+
+// jobsCancel cancels the jobs of the user in the chat, a channel post has no sender
+// and its userid zero cancels the jobs of the channel posts in the chat only
+func jobsCancel(chatid, userid int64) (n int) {
+	JobsMutex.Lock()
+	defer JobsMutex.Unlock()
+	for _, job := range Jobs {
+		if job.Message.Chat.Id != chatid || job.Message.From.Id != userid {
+			continue
+		}
+		if job.Ctx.Err() == nil {
+			job.Cancel()
+			n++
+			if job.Pending {
+				job.Pending = false
+				go func(job *Job) {
+					quotaRefund(job.Ctx, job.Message.From.Id, job.Message.Chat.Id)
+					job.report()
+					job.done()
+				}(job)
+			}
+		}
+	}
+	return n
+}
+
+// jobsCancelId cancels the job if the user is the one who requested it, a bot moderator or an admin of the job chat
+func jobsCancelId(jobid, userid int64) (bool, error) {
+	JobsMutex.Lock()
+	job := Jobs[jobid]
+	JobsMutex.Unlock()
+
+	if job == nil {
+		return false, fmt.Errorf("the job is already finished")
+	}
+
+	if err := job.allowed(userid); err != nil {
+		return false, err
+	}
+
+	job.Cancel()
+
+	JobsMutex.Lock()
+	pending := job.Pending
+	job.Pending = false
+	JobsMutex.Unlock()
+	if pending {
+		// pending jobs are not in the queue so nothing else finishes them
+		quotaRefund(job.Ctx, job.Message.From.Id, job.Message.Chat.Id)
+		job.report()
+		job.done()
+	}
+
+	return true, nil
+}
+
+func (job *Job) allowed(userid int64) error {
+	if userid == job.Message.From.Id || roleAllowed(userid, RoleModerator) {
+		return nil
+	}
+	if job.Message.Chat.Type == "private" {
+		return fmt.Errorf("only the one who requested the job can do it")
+	}
+	aa, err := tggetChatAdministrators(job.Message.Chat.Id)
+	if err != nil {
+		return fmt.Errorf("tggetChatAdministrators: %w", err)
+	}
+	for _, a := range aa {
+		if a.User.Id == userid {
+			return nil
+		}
+	}
+	return fmt.Errorf("only the one who requested the job can do it")
+}
+
+// kind is what the job posts: audio, video or raw
+func (job *Job) kind() string {
+	switch {
+	case job.Raw:
+		return "raw"
+	case job.Video:
+		return "video"
+	}
+	return "audio"
+}
+
+// record counts the result of the video in the metrics and writes it to the audit log
+func (job *Job) record(v YtVideo, err error, bytes int64, elapsed time.Duration) {
+	command := job.kind()
+	outcome, details, class := "ok", "", errclass(err)
+	if job.Ctx.Err() != nil {
+		outcome = "cancelled"
+	} else if err != nil {
+		outcome, details = "error", err.Error()
+	}
+	MetricDownloads.Inc(command, outcome)
+	MetricDownloadBytes.Add(float64(bytes))
+	auditWrite(job.Ctx, AuditEntry{
+		UserId:   job.Message.From.Id,
+		Username: job.Message.From.Username,
+		ChatId:   job.Message.Chat.Id,
+		Command:  command,
+		VideoIds: []string{v.Id},
+		Format:   job.Format,
+		Bytes:    bytes,
+		Outcome:  outcome,
+		Class:    class,
+		Details:  details,
+		Elapsed:  elapsed,
+	})
+}
+
+func tgcancelMarkup(jobid int64) *TgInlineKeyboardMarkup {
+	return &TgInlineKeyboardMarkup{
+		InlineKeyboard: [][]TgInlineKeyboardButton{{
+			{Text: "cancel", CallbackData: fmt.Sprintf("cancel %d", jobid)},
+		}},
+	}
+}
+
+func (job *Job) Run() {
+	m := job.Message
+
+	if job.Ctx.Err() != nil {
+		// cancelled in the queue, nothing of it was started
+		quotaRefund(job.Ctx, m.From.Id, m.Chat.Id)
+		job.report()
+		return
+	}
+
+	logctx(job.Ctx, "job started")
+
+	dir, err := workdirJob(job.Id)
+	if err != nil {
+		logctx(job.Ctx, "ERROR workdirJob: %v", err)
+		if _, err := tgsendMessage(errmessage(errclass(err), err, job.kind()), m.Chat.Id, "", m.MessageId); err != nil {
+			logctx(job.Ctx, "tgsendMessage: %v", err)
+		}
+		return
+	}
+	job.Dir = dir
+	defer removeAll(job.Dir)
+
+	job.Ytdl = &ytdl.Client{HTTPClient: &http.Client{Transport: &UserAgentTransport{http.DefaultTransport, Config().YtHttpClientUserAgent}}}
+
+	for i, v := range job.Videos {
+		vctx := logWith(job.Ctx, "video_id", v.Id)
+		job.Progress.Item(int64(i+1), int64(len(job.Videos)), v.PlaylistTitle)
+
+		if err := quotaCheck(m.From.Id, m.Chat.Id); err != nil {
+			err = fmt.Errorf("%w: %w", ErrQuota, err)
+			logctx(vctx, "%v", err)
+			job.record(v, err, 0, 0)
+			// the next videos would fail the same way
+			job.Failed = append(job.Failed, JobFailure{Video: v, Class: ErrClassQuota, Err: err})
+			break
+		}
+
+		err := job.postRetry(vctx, v)
+		if job.Ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			job.Failed = append(job.Failed, JobFailure{Video: v, Class: errclass(err), Err: err})
+			continue
+		}
+
+		job.Posted = append(job.Posted, v)
+		statePostedAdd(m.Chat.Id, v.Id)
+
+		if len(job.Videos) > 3 && i < len(job.Videos)-1 {
+			job.Progress.Stage("waiting", 0, "")
+			select {
+			case <-job.Ctx.Done():
+			case <-time.After(11 * time.Second):
+			}
+		}
+		if job.Ctx.Err() != nil {
+			break
+		}
+	}
+
+	logctx(job.Ctx, "job finished posted:%d failed:%d of %d", len(job.Posted), len(job.Failed), len(job.Videos))
+
+	if job.Ctx.Err() != nil {
+		job.report()
+		return
+	}
+
+	if len(job.Failed) == 0 {
+		if job.ChannelPost {
+			// TODO do not delete if playlist
+			if err := tgdeleteMessage(m.Chat.Id, m.MessageId); err != nil {
+				logctx(job.Ctx, "tgdeleteMessage: %v", err)
+			}
+		}
+		return
+	}
+
+	var errs []error
+	for _, f := range job.Failed {
+		errs = append(errs, fmt.Errorf("youtu.be/%s %s: %w", f.Video.Id, f.Class, f.Err))
+	}
+	reportFailure(m, errors.Join(errs...))
+
+	var text string
+	if len(job.Videos) == 1 {
+		text = errmessage(job.Failed[0].Class, job.Failed[0].Err, job.kind())
+	} else {
+		text = fmt.Sprintf("posted %d of %d", len(job.Posted), len(job.Videos)) + NL + "skipped:" + NL + strings.Join(job.skipped(), NL)
+	}
+	if _, err := tgsendMessage(text, m.Chat.Id, "", m.MessageId); err != nil {
+		logctx(job.Ctx, "tgsendMessage: %v", err)
+	}
+}
+
+// postRetry posts the video and tries it again from the start after transient errors up to JobRetries times,
+// the video is recorded once with the result of the last attempt
+func (job *Job) postRetry(vctx context.Context, v YtVideo) (err error) {
+	t0, bytes := time.Now(), job.Bytes
+	defer func() { job.record(v, err, job.Bytes-bytes, time.Since(t0)) }()
+
+	for attempt := 1; ; attempt++ {
+		err = job.post(vctx, v)
+		if err == nil || job.Ctx.Err() != nil {
+			return err
+		}
+		class := errclass(err)
+		// the youtube requests are retried by ytretry already
+		var retried *RetriedError
+		if !errretry(class) || errors.As(err, &retried) || attempt > Config().JobRetries {
+			logctx(vctx, "ERROR %s: %v", class, err)
+			return err
+		}
+		delay := backoff(attempt)
+		logctx(vctx, "WARNING %s: %v, retrying in %v attempt:%d", class, err, delay, attempt)
+		job.Progress.Stage(fmt.Sprintf("%s error, retrying in %v", class, delay.Truncate(time.Second)), 0, "")
+		if err := sleepctx(job.Ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// post gets the video info and posts the video as audio, video or raw
+func (job *Job) post(vctx context.Context, v YtVideo) error {
+	m := job.Message
+
+	job.Progress.Stage("getting video info", 0, "")
+
+	var vinfo *ytdl.Video
+	err := ytretry(vctx, "GetVideoContext", func() (err error) {
+		vinfo, err = job.Ytdl.GetVideoContext(job.Ctx, v.Id)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("GetVideoContext: %w", err)
+	}
+
+	post, postname := postAudio, "postAudio"
+	if job.Raw {
+		post, postname = postRaw, "postRaw"
+	} else if job.Video {
+		post, postname = postVideo, "postVideo"
+	}
+
+	bytes := job.Bytes
+	job.Format = ""
+	err = post(job, v, vinfo)
+	if err != nil {
+		return fmt.Errorf("%s: %w", postname, err)
+	}
+
+	quotaAdd(job.Ctx, m.From.Id, m.Chat.Id, vinfo.Duration, job.Bytes-bytes)
+
+	return nil
+}
+
+// skipped lists the failed videos with the reasons and the videos not tried
+func (job *Job) skipped() (skipped []string) {
+	failed := map[string]bool{}
+	for _, f := range job.Failed {
+		failed[f.Video.Id] = true
+		skipped = append(skipped, fmt.Sprintf("youtu.be/%s %s", f.Video.Id, errmessage(f.Class, f.Err, job.kind())))
+	}
+	posted := map[string]bool{}
+	for _, v := range job.Posted {
+		posted[v.Id] = true
+	}
+	for _, v := range job.Videos {
+		if !posted[v.Id] && !failed[v.Id] {
+			skipped = append(skipped, fmt.Sprintf("youtu.be/%s", v.Id))
+		}
+	}
+	if len(skipped) > 20 {
+		skipped = append(skipped[:20], fmt.Sprintf("and %d more", len(skipped)-20))
+	}
+	return skipped
+}
+
+// report sends the summary of a cancelled job
+func (job *Job) report() {
+	text := fmt.Sprintf("cancelled"+NL+"posted %d of %d", len(job.Posted), len(job.Videos))
+
+	if skipped := job.skipped(); len(skipped) > 0 {
+		text += NL + "skipped:" + NL + strings.Join(skipped, NL)
+	}
+
+	_, err := tgsendMessage(text, job.Message.Chat.Id, "", job.Message.MessageId)
+	if err != nil {
+		logctx(job.Ctx, "tgsendMessage: %v", err)
+	}
+}
+
+func processTgCallbackQuery(cq TgCallbackQuery) {
+	log("telegram callback query from:`%s` data:`%s`", cq.From.Username, cq.Data)
+
+	var answer string
+	cmd, arg, _ := strings.Cut(cq.Data, " ")
+	switch cmd {
+	case "start":
+		jobid, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			answer = fmt.Sprintf("invalid job id %s", arg)
+			break
+		}
+		if err := jobsStart(jobid, cq.From.Id); err != nil {
+			answer = err.Error()
+		} else {
+			answer = "starting"
+		}
+	case "cancel":
+		jobid, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			answer = fmt.Sprintf("invalid job id %s", arg)
+			break
+		}
+		if _, err := jobsCancelId(jobid, cq.From.Id); err != nil {
+			answer = err.Error()
+		} else {
+			answer = "cancelling"
+		}
+	default:
+		answer = "unsupported"
+	}
+
+	if err := tganswerCallbackQuery(cq.Id, answer); err != nil {
+		log("tganswerCallbackQuery: %v", err)
+	}
+}
+
+func removeFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log("os.Remove `%s`: %v", path, err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestJobsCancel(t *testing.T) {
+	const chatid, otherchatid, userid, otheruserid = -100, -200, 7, 8
+	newjob := func(chatid, userid int64) *Job {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		return &Job{Ctx: ctx, Cancel: cancel, Message: TgMessage{From: TgUser{Id: userid}, Chat: TgChat{Id: chatid}}}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		userid int64
+		want   []int64
+	}{
+		{"user", userid, []int64{1}},
+		{"channel post without a sender", 0, []int64{3}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := map[int64]*Job{
+				1: newjob(chatid, userid),
+				2: newjob(chatid, otheruserid),
+				3: newjob(chatid, 0),
+				4: newjob(otherchatid, userid),
+				5: newjob(otherchatid, 0),
+			}
+			JobsMutex.Lock()
+			old := Jobs
+			Jobs = jobs
+			JobsMutex.Unlock()
+			t.Cleanup(func() {
+				JobsMutex.Lock()
+				Jobs = old
+				JobsMutex.Unlock()
+			})
+
+			if n := jobsCancel(chatid, tt.userid); n != len(tt.want) {
+				t.Errorf("jobsCancel = %d, want %d", n, len(tt.want))
+			}
+			cancelled := map[int64]bool{}
+			for _, id := range tt.want {
+				cancelled[id] = true
+			}
+			for id, job := range jobs {
+				if got := job.Ctx.Err() != nil; got != cancelled[id] {
+					t.Errorf("job %d cancelled:%v, want %v", id, got, cancelled[id])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	LogFormatCompact = "compact"
+	LogFormatText    = "text"
+	LogFormatJson    = "json"
+)
+
+var (
+	LoggerPtr atomic.Pointer[slog.Logger]
+)
+
+type logAttrsKey struct{}
+
+// logWith returns the context with the fields added to every line logged with it, like job_id or video_id
+func logWith(ctx context.Context, args ...any) context.Context {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	attrs = append(attrs[:len(attrs):len(attrs)], argsToAttrs(args)...)
+	return context.WithValue(ctx, logAttrsKey{}, attrs)
+}
+
+func argsToAttrs(args []any) (attrs []slog.Attr) {
+	for i := 0; i+1 < len(args); i += 2 {
+		attrs = append(attrs, slog.Any(fmt.Sprint(args[i]), args[i+1]))
+	}
+	return attrs
+}
+
+// log formats the message like fmt.Sprintf, the ERROR WARNING and DEBUG prefixes of the message set the level
+func log(msg string, args ...interface{}) {
+	logctx(context.Background(), msg, args...)
+}
+
+// logctx is log with the fields of the context
+func logctx(ctx context.Context, msg string, args ...interface{}) {
+	level := slog.LevelInfo
+	for prefix, l := range map[string]slog.Level{"ERROR ": slog.LevelError, "WARNING ": slog.LevelWarn, "DEBUG ": slog.LevelDebug} {
+		if strings.HasPrefix(msg, prefix) {
+			msg, level = strings.TrimPrefix(msg, prefix), l
+			break
+		}
+	}
+
+	logger := LoggerPtr.Load()
+	if logger == nil {
+		logger = slog.New(NewCompactHandler(os.Stderr, slog.LevelInfo))
+	}
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	logger.LogAttrs(ctx, level, redact(fmt.Sprintf(msg, args...)), attrs...)
+}
+
+// logInit sets the logger from LogFormat and LogLevel of the current config, DEBUG is the same as the debug level
+func logInit() {
+	config := Config()
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		level = slog.LevelInfo
+	}
+	if config.DEBUG {
+		level = slog.LevelDebug
+	}
+
+	var handler slog.Handler
+	switch config.LogFormat {
+	case LogFormatText:
+		handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	case LogFormatJson:
+		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	default:
+		handler = NewCompactHandler(os.Stderr, level)
+	}
+	LoggerPtr.Store(slog.New(handler))
+}
+
+// CompactHandler writes the lines like `024:1019:0307 WARNING message job_id=1 video_id=x` with the ts timestamp
+type CompactHandler struct {
+	w     io.Writer
+	mu    *sync.Mutex
+	level slog.Leveler
+	attrs []slog.Attr
+}
+
+func NewCompactHandler(w io.Writer, level slog.Leveler) *CompactHandler {
+	return &CompactHandler{w: w, mu: &sync.Mutex{}, level: level}
+}
+
+func (h *CompactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *CompactHandler) Handle(ctx context.Context, r slog.Record) error {
+	var sb strings.Builder
+	sb.WriteString(ts())
+	switch {
+	case r.Level >= slog.LevelError:
+		sb.WriteString(" ERROR")
+	case r.Level >= slog.LevelWarn:
+		sb.WriteString(" WARNING")
+	case r.Level < slog.LevelInfo:
+		sb.WriteString(" DEBUG")
+	}
+	sb.WriteString(" " + r.Message)
+
+	writeattr := func(a slog.Attr) bool {
+		fmt.Fprintf(&sb, " %s=%v", a.Key, a.Value)
+		return true
+	}
+	for _, a := range h.attrs {
+		writeattr(a)
+	}
+	r.Attrs(writeattr)
+	sb.WriteString(NL)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, sb.String())
+	return err
+}
+
+func (h *CompactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)
+	return &h2
+}
+
+// groups are not used so the attrs of a group are written as they are
+func (h *CompactHandler) WithGroup(name string) slog.Handler {
+	return h
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the metrics are written in the prometheus text format
+// https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+
+type Metric interface {
+	write(w io.Writer)
+}
+
+var Metrics []Metric
+
+type Counter struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{Name: name, Help: help, Labels: labels, values: map[string]float64{}}
+	Metrics = append(Metrics, c)
+	return c
+}
+
+func (c *Counter) Add(v float64, labelvalues ...string) {
+	key := metricLabels(c.Labels, labelvalues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) Inc(labelvalues ...string) {
+	c.Add(1, labelvalues...)
+}
+
+func (c *Counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s"+NL+"# TYPE %s counter"+NL, c.Name, c.Help, c.Name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range metricKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s"+NL, c.Name, key, metricValue(c.values[key]))
+	}
+}
+
+// GaugeFunc reads the value when the metrics are scraped
+type GaugeFunc struct {
+	Name  string
+	Help  string
+	Value func() float64
+}
+
+func NewGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{Name: name, Help: help, Value: value}
+	Metrics = append(Metrics, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s"+NL+"# TYPE %s gauge"+NL, g.Name, g.Help, g.Name)
+	fmt.Fprintf(w, "%s %s"+NL, g.Name, metricValue(g.Value()))
+}
+
+type Histogram struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{Name: name, Help: help, Labels: labels, Buckets: buckets, values: map[string]*histogramValue{}}
+	Metrics = append(Metrics, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelvalues ...string) {
+	key := metricLabels(h.Labels, labelvalues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv := h.values[key]
+	if hv == nil {
+		hv = &histogramValue{counts: make([]uint64, len(h.Buckets))}
+		h.values[key] = hv
+	}
+	for i, b := range h.Buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) ObserveSince(t0 time.Time, labelvalues ...string) {
+	h.Observe(time.Since(t0).Seconds(), labelvalues...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s"+NL+"# TYPE %s histogram"+NL, h.Name, h.Help, h.Name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range metricKeys(h.values) {
+		hv := h.values[key]
+		// the le label goes after the other labels
+		prefix := "{"
+		if key != "" {
+			prefix = strings.TrimSuffix(key, "}") + ","
+		}
+		for i, b := range h.Buckets {
+			fmt.Fprintf(w, "%s_bucket%sle=\"%s\"} %d"+NL, h.Name, prefix, metricValue(b), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%sle=\"+Inf\"} %d"+NL, h.Name, prefix, hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s"+NL, h.Name, key, metricValue(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d"+NL, h.Name, key, hv.count)
+	}
+}
+
+func metricLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var ll []string
+	for i, name := range names {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		ll = append(ll, fmt.Sprintf("%s=%s", name, strconv.Quote(v)))
+	}
+	return "{" + strings.Join(ll, ",") + "}"
+}
+
+func metricKeys[V any](m map[string]V) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func metricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	MetricsDurationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800}
+	MetricsLatencyBuckets  = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+	MetricUpdates = NewCounter("tgze_updates_total", "Telegram updates processed by type.", "type")
+
+	MetricDownloads     = NewCounter("tgze_downloads_total", "Videos processed by media type and outcome.", "media", "outcome")
+	MetricDownloadBytes = NewCounter("tgze_download_bytes_total", "Bytes downloaded from youtube.")
+	MetricUploadBytes   = NewCounter("tgze_upload_bytes_total", "Bytes uploaded to telegram.")
+
+	MetricDownloadDuration  = NewHistogram("tgze_download_duration_seconds", "Duration of youtube downloads by media type.", MetricsDurationBuckets, "media")
+	MetricTranscodeDuration = NewHistogram("tgze_transcode_duration_seconds", "Duration of ffmpeg transcoding.", MetricsDurationBuckets)
+	MetricUploadDuration    = NewHistogram("tgze_upload_duration_seconds", "Duration of telegram uploads by method.", MetricsDurationBuckets, "method")
+
+	MetricApiRequests  = NewCounter("tgze_api_requests_total", "Telegram and youtube api requests by api and method.", "api", "method")
+	MetricApiDuration  = NewHistogram("tgze_api_request_duration_seconds", "Duration of telegram and youtube api requests by api.", MetricsLatencyBuckets, "api")
+	MetricTgApiErrors  = NewCounter("tgze_telegram_errors_total", "Telegram api errors by method and description.", "method", "description")
+	MetricYoutubeError = NewCounter("tgze_youtube_errors_total", "Youtube errors by call.", "call")
+
+	MetricStorePutDuration = NewHistogram("tgze_store_put_duration_seconds", "Latency of the state store Put by outcome.", MetricsLatencyBuckets, "outcome")
+
+	_ = NewGaugeFunc("tgze_queue_depth", "Jobs waiting in the queue.", func() float64 { return float64(len(JobsQueue)) })
+	_ = NewGaugeFunc("tgze_jobs", "Jobs queued, pending confirmation or running.", func() float64 {
+		JobsMutex.Lock()
+		defer JobsMutex.Unlock()
+		return float64(len(Jobs))
+	})
+)
+
+// the numbers in descriptions like `retry after 33` would make a new series for every value
+var metricsNumberRe = regexp.MustCompile("[0-9]+")
+
+// metricsApiResponse counts the request to the telegram or youtube api at the url, the token in the url is not used
+func metricsApiResponse(rawurl string, t0 time.Time, status int, body []byte, err error) {
+	api, method := "other", ""
+	if u, perr := url.Parse(rawurl); perr == nil {
+		method = u.Path[strings.LastIndex(u.Path, "/")+1:]
+		switch {
+		case strings.HasPrefix(rawurl, Config().TgApiUrlBase):
+			api = "telegram"
+		case strings.HasSuffix(u.Host, "googleapis.com"):
+			api = "youtube"
+		}
+	}
+
+	MetricApiRequests.Inc(api, method)
+	MetricApiDuration.ObserveSince(t0, api)
+
+	switch api {
+	case "telegram":
+		var tgresp TgResponseShort
+		if err != nil {
+			MetricTgApiErrors.Inc(method, "request failed")
+		} else if json.Unmarshal(body, &tgresp) == nil && !tgresp.Ok {
+			MetricTgApiErrors.Inc(method, metricsNumberRe.ReplaceAllString(tgresp.Description, "N"))
+		}
+	case "youtube":
+		if err != nil || status != http.StatusOK {
+			MetricYoutubeError.Inc(method)
+		}
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range Metrics {
+		m.write(w)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	ytdl "github.com/kkdai/youtube/v2"
+)
+
+// ffmpegPipelineUpload reports if the output of ffmpeg can go straight to telegram,
+// a local telegram api server takes the files by their paths so it needs a file
+func ffmpegPipelineUpload() bool {
+	config := Config()
+	return config.FfmpegPipelineUpload && !config.TgApiLocal
+}
+
+// ffmpegPipelineSource reports if ffmpeg can read the format from a pipe. the adaptive mp4 formats are fragmented
+// and webm is written as a stream, a plain mp4 can have its index at the end that needs seeking so it goes through a file
+func ffmpegPipelineSource(f ytdl.Format) bool {
+	mimetype, _, _ := strings.Cut(f.MimeType, ";")
+	switch strings.TrimSpace(mimetype) {
+	case "audio/webm", "video/webm":
+		return true
+	case "audio/mp4", "video/mp4":
+		return f.InitRange != nil
+	}
+	return false
+}
+
+// ffmpegPipelineUploadSize is the size a streamed upload targets, its output is not checked before
+// telegram gets it so it is lower than the limit by FfmpegPipelineUploadMarginPercent
+func ffmpegPipelineUploadSize() int64 {
+	return tgmaxfilesize() * (100 - Config().FfmpegPipelineUploadMarginPercent) / 100
+}
+
+// FfmpegPipeline transcodes the stream as it is downloaded, to the file filename2 or if send is not nil
+// straight to send so the download the transcoding and the upload go together.
+// it returns the number of bytes read from the stream
+func FfmpegPipeline(ctx context.Context, ytstream io.Reader, filename2 string, target FfmpegTarget, progress *TgProgress, send func(io.Reader) error) (int64, error) {
+	// the progress shows the transcoded seconds from ffmpeg, not the downloaded bytes
+	stdin := &ProgressReader{Reader: ytstream}
+
+	if send == nil {
+		err := FfmpegTranscode(ctx, "", filename2, stdin, nil, target, progress)
+		return stdin.n, stdin.failed(err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	piper, pipew := io.Pipe()
+	ffmpegerr := make(chan error, 1)
+	go func() {
+		err := FfmpegTranscode(ctx, "", "", stdin, pipew, target, progress)
+		// the error is passed before the pipe is closed so a failed upload can tell if ffmpeg failed first
+		ffmpegerr <- err
+		pipew.CloseWithError(err)
+	}()
+
+	err := send(piper)
+	// ffmpeg writing after a failed upload gets an error instead of blocking
+	piper.Close()
+
+	select {
+	case ferr := <-ffmpegerr:
+		if ferr != nil {
+			return stdin.n, stdin.failed(ferr)
+		}
+	default:
+		cancel()
+		<-ffmpegerr
+	}
+	return stdin.n, err
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TgProgress struct {
+	ChatId    int64
+	MessageId int64
+	Markup    *TgInlineKeyboardMarkup
+
+	// ctx is the context of the job for the log
+	ctx context.Context
+	mu  sync.Mutex
+
+	item     string
+	header   string
+	stage    string
+	done     int64
+	total    int64
+	unit     string
+	lastedit time.Time
+	lasttext string
+
+	// edits has the latest text not sent yet, the edits are sent by editLoop
+	// so the downloads and ffmpeg do not wait for the telegram api
+	edits     chan tgprogressEdit
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeonce sync.Once
+}
+
+type tgprogressEdit struct {
+	text   string
+	markup *TgInlineKeyboardMarkup
+}
+
+var (
+	TgRetryAfterRe = regexp.MustCompile("Too Many Requests: retry after ([0-9]+)")
+)
+
+// tgnewProgress sends the status message of a job, all later stages edit this one message
+func tgnewProgress(ctx context.Context, chatid, replytomessageid int64, text string, markup *TgInlineKeyboardMarkup) *TgProgress {
+	msg, err := tgsendMessageMarkup(text, chatid, "", replytomessageid, markup)
+	if err != nil {
+		logctx(ctx, "tgnewProgress tgsendMessageMarkup: %v", err)
+		return nil
+	}
+	p := &TgProgress{
+		ChatId:    chatid,
+		MessageId: msg.MessageId,
+		Markup:    markup,
+		ctx:       ctx,
+		stage:     text,
+		lastedit:  time.Now(),
+		lasttext:  text,
+		edits:     make(chan tgprogressEdit, 1),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go p.editLoop()
+	return p
+}
+
+func (p *TgProgress) Item(index, size int64, title string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if size > 1 {
+		p.item = fmt.Sprintf("%d/%d %s", index, size, title)
+	} else {
+		p.item = ""
+	}
+	p.header = ""
+	p.mu.Unlock()
+}
+
+func (p *TgProgress) Header(header string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.header = header
+	p.mu.Unlock()
+}
+
+// Stage switches to the next stage and edits the message right away
+func (p *TgProgress) Stage(stage string, total int64, unit string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.stage, p.done, p.total, p.unit = stage, 0, total, unit
+	p.mu.Unlock()
+	p.edit(true)
+}
+
+// Update sets the progress of the current stage and edits the message not more often than TgProgressInterval
+func (p *TgProgress) Update(done int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.done = done
+	p.mu.Unlock()
+	p.edit(false)
+}
+
+// Close sends the last edit and stops the edits, the message is kept
+func (p *TgProgress) Close() {
+	if p == nil {
+		return
+	}
+	p.closeonce.Do(func() { close(p.stop) })
+	<-p.stopped
+}
+
+func (p *TgProgress) Delete() {
+	if p == nil {
+		return
+	}
+	p.Close()
+	if err := tgdeleteMessage(p.ChatId, p.MessageId); err != nil {
+		logctx(p.ctx, "TgProgress tgdeleteMessage: %v", err)
+	}
+}
+
+func (p *TgProgress) text() string {
+	var lines []string
+	if p.item != "" {
+		lines = append(lines, p.item)
+	}
+	if p.header != "" {
+		lines = append(lines, p.header)
+	}
+	stage := p.stage
+	switch {
+	case p.unit == "mb" && p.total > 0:
+		stage += fmt.Sprintf(" %d/%dmb %d%%", p.done>>20, p.total>>20, p.done*100/p.total)
+	case p.unit == "mb":
+		stage += fmt.Sprintf(" %dmb", p.done>>20)
+	case p.unit == "%" && p.total > 0:
+		stage += fmt.Sprintf(" %d%%", p.done*100/p.total)
+	}
+	lines = append(lines, stage)
+	return strings.Join(lines, NL)
+}
+
+// edit passes the text to editLoop, a text not sent yet is replaced by the new one
+func (p *TgProgress) edit(force bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !force && time.Since(p.lastedit) < Config().TgProgressInterval {
+		return
+	}
+	if time.Now().Before(p.lastedit) {
+		// telegram asked to retry later
+		return
+	}
+	text := p.text()
+	if text == p.lasttext {
+		return
+	}
+	p.lastedit = time.Now()
+	p.lasttext = text
+
+	// the senders hold the mutex so after the old edit is taken out the new one fits
+	select {
+	case <-p.edits:
+	default:
+	}
+	p.edits <- tgprogressEdit{text: text, markup: p.Markup}
+}
+
+func (p *TgProgress) editLoop() {
+	defer close(p.stopped)
+	for {
+		select {
+		case e := <-p.edits:
+			p.send(e)
+		case <-p.stop:
+			select {
+			case e := <-p.edits:
+				p.send(e)
+			default:
+			}
+			return
+		}
+	}
+}
+
+func (p *TgProgress) send(e tgprogressEdit) {
+	err := tgeditMessageText(p.ChatId, p.MessageId, e.text, e.markup)
+	if err != nil {
+		logctx(p.ctx, "TgProgress tgeditMessageText: %v", err)
+		if mm := TgRetryAfterRe.FindStringSubmatch(err.Error()); len(mm) > 1 {
+			if seconds, err := strconv.Atoi(mm[1]); err == nil {
+				p.mu.Lock()
+				p.lastedit = time.Now().Add(time.Duration(seconds) * time.Second)
+				p.mu.Unlock()
+			}
+		}
+	}
+}
+
+type ProgressReader struct {
+	Reader   io.Reader
+	Progress *TgProgress
+	n        int64
+	// err is the last read error other than io.EOF
+	err error
+}
+
+func (pr *ProgressReader) Read(b []byte) (n int, err error) {
+	n, err = pr.Reader.Read(b)
+	pr.n += int64(n)
+	if err != nil && err != io.EOF {
+		pr.err = err
+	}
+	pr.Progress.Update(pr.n)
+	return n, err
+}
+
+// failed returns the read error in place of err, ffmpeg fails after its input breaks
+// and the failure is the download one then, not a transcode one
+func (pr *ProgressReader) failed(err error) error {
+	if err != nil && pr.err != nil {
+		return fmt.Errorf("download: %w", pr.err)
+	}
+	return err
+}
+
+// ffmpegprogress reads the key=value lines of ffmpeg `-progress pipe:1` output
+func ffmpegprogress(r io.Reader, p *TgProgress) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		// out_time_ms is in microseconds as well
+		if k == "out_time_us" || k == "out_time_ms" {
+			if us, err := strconv.ParseInt(v, 10, 64); err == nil && us > 0 {
+				p.Update(us / 1000000)
+			}
+		}
+	}
+}
+
+func tgeditMessageText(chatid, messageid int64, text string, markup *TgInlineKeyboardMarkup) error {
+	// https://core.telegram.org/bots/api#editmessagetext
+	editMessageText := map[string]interface{}{
+		"chat_id":                  chatid,
+		"message_id":               messageid,
+		"text":                     redact(text),
+		"disable_web_page_preview": true,
+	}
+	if markup != nil {
+		// the inline keyboard is removed on edits without reply_markup
+		editMessageText["reply_markup"] = markup
+	}
+	editMessageTextJSON, err := json.Marshal(editMessageText)
+	if err != nil {
+		return err
+	}
+
+	var tgresp TgResponseShort
+	err = postJson(
+		fmt.Sprintf("%s/bot%s/editMessageText", Config().TgApiUrlBase, Config().TgToken),
+		bytes.NewBuffer(editMessageTextJSON),
+		&tgresp,
+	)
+	if err != nil {
+		return fmt.Errorf("postJson: %w", err)
+	}
+
+	if !tgresp.Ok {
+		if strings.Contains(tgresp.Description, "message is not modified") {
+			return nil
+		}
+		return fmt.Errorf("editMessageText: %s", tgresp.Description)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTgProgressAsync(t *testing.T) {
+	// the first edit waits until release is closed
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var edits []string
+	tg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/sendMessage"):
+			w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+		case strings.HasSuffix(r.URL.Path, "/editMessageText"):
+			<-release
+			var edit struct{ Text string }
+			json.NewDecoder(r.Body).Decode(&edit)
+			mu.Lock()
+			edits = append(edits, edit.Text)
+			mu.Unlock()
+			w.Write([]byte(`{"ok":true}`))
+		}
+	}))
+	defer tg.Close()
+	testConfig(t, func(config *TgZeConfig) {
+		config.TgApiUrlBase = tg.URL
+		config.TgProgressInterval = time.Nanosecond
+	})
+
+	p := tgnewProgress(context.Background(), 1, 0, "queued", nil)
+	if p == nil {
+		t.Fatalf("tgnewProgress = nil")
+	}
+	p.Stage("downloading", 100<<20, "mb")
+
+	t0 := time.Now()
+	for mb := int64(1); mb <= 100; mb++ {
+		time.Sleep(time.Millisecond)
+		p.Update(mb << 20)
+	}
+	if d := time.Since(t0); d > 5*time.Second {
+		t.Errorf("the updates waited %v for the telegram api", d)
+	}
+
+	close(release)
+	p.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	// the edits not sent while the first one waited are replaced by the latest
+	if len(edits) == 0 || len(edits) > 3 {
+		t.Fatalf("edits = %q, want the first one and the latest", edits)
+	}
+	if last := edits[len(edits)-1]; last != "downloading 100/100mb 100%" {
+		t.Errorf("the last edit = %q, want the latest progress", last)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// TgQuota limits the requests with a token bucket and the daily usage, zero fields are not limited
+type TgQuota struct {
+	RatePerHour float64 `yaml:"RatePerHour"`
+	RateBurst   int     `yaml:"RateBurst"`
+
+	DailyCount    int           `yaml:"DailyCount"`
+	DailyDuration time.Duration `yaml:"DailyDuration"`
+	DailyBytes    int64         `yaml:"DailyBytes"`
+}
+
+// TgUsage is the persisted counter of a user or a chat, the daily fields are reset when Day changes
+type TgUsage struct {
+	Tokens   float64   `yaml:"Tokens"`
+	TokensAt time.Time `yaml:"TokensAt"`
+
+	Day      string        `yaml:"Day"`
+	Count    int           `yaml:"Count"`
+	Duration time.Duration `yaml:"Duration"`
+	Bytes    int64         `yaml:"Bytes"`
+}
+
+func (q TgQuota) Validate() error {
+	if q.RatePerHour < 0 || q.RateBurst < 0 || q.DailyCount < 0 || q.DailyDuration < 0 || q.DailyBytes < 0 {
+		return fmt.Errorf("limits should not be negative")
+	}
+	if (q.RatePerHour > 0) != (q.RateBurst > 0) {
+		return fmt.Errorf("RatePerHour and RateBurst should be set together")
+	}
+	return nil
+}
+
+// rated reports if the requests are limited by the token bucket
+func (q TgQuota) rated() bool {
+	return q.RatePerHour > 0 && q.RateBurst > 0
+}
+
+// unlimited reports if no field of the quota limits anything
+func (q TgQuota) unlimited() bool {
+	return !q.rated() && q.DailyCount == 0 && q.DailyDuration == 0 && q.DailyBytes == 0
+}
+
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// quotaFor returns the limits for the user and for the chat, TgQuotaChats overrides both for the chat
+func quotaFor(chatid int64) (userquota, chatquota TgQuota) {
+	config := Config()
+	userquota, chatquota = config.TgQuotaUser, config.TgQuotaChat
+	if q, ok := config.TgQuotaChats[chatid]; ok {
+		userquota, chatquota = q, q
+	}
+	return userquota, chatquota
+}
+
+// refresh resets the daily counters on a new day and refills the tokens
+func (u *TgUsage) refresh(q TgQuota, now time.Time) {
+	if day := quotaDay(now); u.Day != day {
+		u.Day, u.Count, u.Duration, u.Bytes = day, 0, 0, 0
+	}
+	if !q.rated() {
+		return
+	}
+	if u.TokensAt.IsZero() {
+		u.Tokens = float64(q.RateBurst)
+	} else {
+		u.Tokens += now.Sub(u.TokensAt).Hours() * q.RatePerHour
+	}
+	u.Tokens = math.Min(u.Tokens, float64(q.RateBurst))
+	u.TokensAt = now
+}
+
+// check returns why the usage does not allow a request of count videos
+func (u *TgUsage) check(q TgQuota, count int) error {
+	if q.rated() && u.Tokens < 1 {
+		wait := time.Duration((1 - u.Tokens) / q.RatePerHour * float64(time.Hour))
+		return fmt.Errorf("too many requests, please try again in %v", wait.Round(time.Minute)+time.Minute)
+	}
+	if q.DailyCount > 0 && u.Count+count > q.DailyCount {
+		return fmt.Errorf("the daily limit of %d videos allows %d more today", q.DailyCount, max(q.DailyCount-u.Count, 0))
+	}
+	if q.DailyDuration > 0 && u.Duration >= q.DailyDuration {
+		return fmt.Errorf("the daily limit of %v total duration is used up", q.DailyDuration)
+	}
+	if q.DailyBytes > 0 && u.Bytes >= q.DailyBytes {
+		return fmt.Errorf("the daily limit of %dmb is used up", q.DailyBytes>>20)
+	}
+	return nil
+}
+
+func (u TgUsage) String(q TgQuota) string {
+	var ss []string
+	if q.rated() {
+		ss = append(ss, fmt.Sprintf("requests %d of %d (%.1f per hour)", int(u.Tokens), q.RateBurst, q.RatePerHour))
+	}
+	if q.DailyCount > 0 {
+		ss = append(ss, fmt.Sprintf("videos %d of %d", max(q.DailyCount-u.Count, 0), q.DailyCount))
+	}
+	if q.DailyDuration > 0 {
+		ss = append(ss, fmt.Sprintf("duration %v of %v", max(q.DailyDuration-u.Duration, 0), q.DailyDuration))
+	}
+	if q.DailyBytes > 0 {
+		ss = append(ss, fmt.Sprintf("size %dmb of %dmb", max(q.DailyBytes-u.Bytes, 0)>>20, q.DailyBytes>>20))
+	}
+	if len(ss) == 0 {
+		return "unlimited"
+	}
+	return strings.Join(ss, NL)
+}
+
+// quotaTake checks the limits of the user and the chat for a request of count videos and takes a token from both buckets
+func quotaTake(ctx context.Context, userid, chatid int64, count int) error {
+	if roleAllowed(userid, RoleModerator) {
+		return nil
+	}
+	userquota, chatquota := quotaFor(chatid)
+	if userquota.unlimited() && chatquota.unlimited() {
+		return nil
+	}
+
+	var quotaerr error
+	now := time.Now()
+	err := stateUpdate(func(state *TgZeState) {
+		quotaerr = nil
+		if state.TgUserUsage == nil {
+			state.TgUserUsage = make(map[int64]TgUsage)
+		}
+		if state.TgChatUsage == nil {
+			state.TgChatUsage = make(map[int64]TgUsage)
+		}
+		uu, cu := state.TgUserUsage[userid], state.TgChatUsage[chatid]
+		uu.refresh(userquota, now)
+		cu.refresh(chatquota, now)
+		if userid != 0 {
+			if err := uu.check(userquota, count); err != nil {
+				quotaerr = err
+				return
+			}
+		}
+		if err := cu.check(chatquota, count); err != nil {
+			quotaerr = fmt.Errorf("chat: %w", err)
+			return
+		}
+		if userquota.rated() {
+			uu.Tokens--
+		}
+		if chatquota.rated() {
+			cu.Tokens--
+		}
+		if userid != 0 {
+			state.TgUserUsage[userid] = uu
+		}
+		state.TgChatUsage[chatid] = cu
+	})
+	if err != nil {
+		// the limits are not a reason to stop the bot if the state store is down
+		logctx(ctx, "ERROR stateUpdate: %v", err)
+	}
+	return quotaerr
+}
+
+// quotaRefund gives back the tokens taken by quotaTake for a request that was not started
+func quotaRefund(ctx context.Context, userid, chatid int64) {
+	if roleAllowed(userid, RoleModerator) {
+		return
+	}
+	userquota, chatquota := quotaFor(chatid)
+	if !userquota.rated() && !chatquota.rated() {
+		return
+	}
+
+	now := time.Now()
+	err := stateUpdate(func(state *TgZeState) {
+		if uu, ok := state.TgUserUsage[userid]; ok && userid != 0 && userquota.rated() {
+			uu.refresh(userquota, now)
+			uu.Tokens = math.Min(uu.Tokens+1, float64(userquota.RateBurst))
+			state.TgUserUsage[userid] = uu
+		}
+		if cu, ok := state.TgChatUsage[chatid]; ok && chatquota.rated() {
+			cu.refresh(chatquota, now)
+			cu.Tokens = math.Min(cu.Tokens+1, float64(chatquota.RateBurst))
+			state.TgChatUsage[chatid] = cu
+		}
+	})
+	if err != nil {
+		logctx(ctx, "ERROR stateUpdate: %v", err)
+	}
+}
+
+// quotaCheck reports if the daily usage is still under the limits, it is checked before every video of a job
+func quotaCheck(userid, chatid int64) error {
+	if roleAllowed(userid, RoleModerator) {
+		return nil
+	}
+	userquota, chatquota := quotaFor(chatid)
+	// the rate is checked once per request so the tokens are not checked here
+	userquota.RatePerHour, chatquota.RatePerHour = 0, 0
+
+	now := time.Now()
+	StateMutex.Lock()
+	defer StateMutex.Unlock()
+	uu, cu := State.TgUserUsage[userid], State.TgChatUsage[chatid]
+	uu.refresh(userquota, now)
+	cu.refresh(chatquota, now)
+	if userid != 0 {
+		if err := uu.check(userquota, 1); err != nil {
+			return err
+		}
+	}
+	if err := cu.check(chatquota, 1); err != nil {
+		return fmt.Errorf("chat: %w", err)
+	}
+	return nil
+}
+
+// quotaAdd counts a posted video for the user and the chat
+func quotaAdd(ctx context.Context, userid, chatid int64, duration time.Duration, bytes int64) {
+	now := time.Now()
+	err := stateUpdate(func(state *TgZeState) {
+		if state.TgUserUsage == nil {
+			state.TgUserUsage = make(map[int64]TgUsage)
+		}
+		if state.TgChatUsage == nil {
+			state.TgChatUsage = make(map[int64]TgUsage)
+		}
+		for _, u := range []struct {
+			usage map[int64]TgUsage
+			id    int64
+		}{{state.TgUserUsage, userid}, {state.TgChatUsage, chatid}} {
+			if u.id == 0 {
+				continue
+			}
+			usage := u.usage[u.id]
+			if day := quotaDay(now); usage.Day != day {
+				usage.Day, usage.Count, usage.Duration, usage.Bytes = day, 0, 0, 0
+			}
+			usage.Count++
+			usage.Duration += duration
+			usage.Bytes += bytes
+			u.usage[u.id] = usage
+		}
+	})
+	if err != nil {
+		logctx(ctx, "ERROR stateUpdate: %v", err)
+	}
+}
+
+// quotaStatus is the reply to /quota
+func quotaStatus(userid, chatid int64) string {
+	if roleAllowed(userid, RoleModerator) {
+		return "unlimited for the bot moderators"
+	}
+	userquota, chatquota := quotaFor(chatid)
+
+	now := time.Now()
+	StateMutex.Lock()
+	uu, cu := State.TgUserUsage[userid], State.TgChatUsage[chatid]
+	StateMutex.Unlock()
+	uu.refresh(userquota, now)
+	cu.refresh(chatquota, now)
+
+	return "you:" + NL + uu.String(userquota) + NL + NL + "this chat:" + NL + cu.String(chatquota)
+}
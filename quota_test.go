@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTgUsageRefresh(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	rated := TgQuota{RatePerHour: 2, RateBurst: 5}
+	for _, tt := range []struct {
+		name   string
+		quota  TgQuota
+		usage  TgUsage
+		tokens float64
+	}{
+		{"new usage gets the burst", rated, TgUsage{}, 5},
+		{"refills by the rate", rated, TgUsage{Tokens: 1, TokensAt: now.Add(-time.Hour)}, 3},
+		{"refills part of a token", rated, TgUsage{Tokens: 1, TokensAt: now.Add(-15 * time.Minute)}, 1.5},
+		{"not more than the burst", rated, TgUsage{Tokens: 4, TokensAt: now.Add(-10 * time.Hour)}, 5},
+		{"refills from negative", rated, TgUsage{Tokens: -1, TokensAt: now.Add(-time.Hour)}, 1},
+		{"not rated keeps the tokens", TgQuota{DailyCount: 3}, TgUsage{Tokens: 1, TokensAt: now.Add(-time.Hour)}, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			u := tt.usage
+			u.refresh(tt.quota, now)
+			if math.Abs(u.Tokens-tt.tokens) > 1e-9 {
+				t.Errorf("Tokens = %v, want %v", u.Tokens, tt.tokens)
+			}
+		})
+	}
+}
+
+func TestTgUsageRefreshDay(t *testing.T) {
+	now := time.Date(2024, 5, 10, 0, 5, 0, 0, time.UTC)
+	u := TgUsage{Day: "2024-05-09", Count: 3, Duration: time.Hour, Bytes: 100}
+	u.refresh(TgQuota{}, now)
+	if u.Day != "2024-05-10" || u.Count != 0 || u.Duration != 0 || u.Bytes != 0 {
+		t.Errorf("usage of the previous day is not reset: %+v", u)
+	}
+
+	u = TgUsage{Day: "2024-05-10", Count: 3}
+	u.refresh(TgQuota{}, now)
+	if u.Count != 3 {
+		t.Errorf("Count = %d, want 3", u.Count)
+	}
+}
+
+func TestTgUsageCheck(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		quota TgQuota
+		usage TgUsage
+		count int
+		ok    bool
+	}{
+		{"unlimited", TgQuota{}, TgUsage{Tokens: -3, Count: 100}, 10, true},
+		{"a token left", TgQuota{RatePerHour: 1, RateBurst: 3}, TgUsage{Tokens: 1}, 1, true},
+		{"less than a token", TgQuota{RatePerHour: 1, RateBurst: 3}, TgUsage{Tokens: 0.9}, 1, false},
+		{"count under the limit", TgQuota{DailyCount: 10}, TgUsage{Count: 5}, 5, true},
+		{"count over the limit", TgQuota{DailyCount: 10}, TgUsage{Count: 5}, 6, false},
+		{"duration used up", TgQuota{DailyDuration: time.Hour}, TgUsage{Duration: time.Hour}, 1, false},
+		{"bytes left", TgQuota{DailyBytes: 100 << 20}, TgUsage{Bytes: 99 << 20}, 1, true},
+		{"bytes used up", TgQuota{DailyBytes: 100 << 20}, TgUsage{Bytes: 100 << 20}, 1, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			u := tt.usage
+			if err := u.check(tt.quota, tt.count); (err == nil) != tt.ok {
+				t.Errorf("check = %v, want ok:%v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTgQuotaUnlimited(t *testing.T) {
+	for _, tt := range []struct {
+		quota     TgQuota
+		rated     bool
+		unlimited bool
+	}{
+		{TgQuota{}, false, true},
+		{TgQuota{RatePerHour: 1, RateBurst: 1}, true, false},
+		{TgQuota{RatePerHour: 1}, false, true},
+		{TgQuota{DailyCount: 1}, false, false},
+		{TgQuota{DailyDuration: time.Minute}, false, false},
+		{TgQuota{DailyBytes: 1}, false, false},
+	} {
+		if got := tt.quota.rated(); got != tt.rated {
+			t.Errorf("%+v.rated() = %v, want %v", tt.quota, got, tt.rated)
+		}
+		if got := tt.quota.unlimited(); got != tt.unlimited {
+			t.Errorf("%+v.unlimited() = %v, want %v", tt.quota, got, tt.unlimited)
+		}
+	}
+}
+
+func TestJobRunCancelledRefunds(t *testing.T) {
+	tg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	}))
+	defer tg.Close()
+	testConfig(t, func(config *TgZeConfig) {
+		config.TgApiUrlBase = tg.URL
+		config.TgQuotaUser = TgQuota{RatePerHour: 1, RateBurst: 3}
+		config.TgQuotaChat = TgQuota{RatePerHour: 1, RateBurst: 5}
+	})
+	testState(t)
+
+	const userid, chatid = 7, -100
+	if err := quotaTake(context.Background(), userid, chatid, 1); err != nil {
+		t.Fatalf("quotaTake: %v", err)
+	}
+
+	// the job is cancelled while it is in the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	job := &Job{Ctx: ctx, Cancel: cancel, Message: TgMessage{From: TgUser{Id: userid}, Chat: TgChat{Id: chatid}}}
+	job.Run()
+
+	if tokens := State.TgUserUsage[userid].Tokens; math.Abs(tokens-3) > 1e-3 {
+		t.Errorf("user Tokens = %v, want 3", tokens)
+	}
+	if tokens := State.TgChatUsage[chatid].Tokens; math.Abs(tokens-5) > 1e-3 {
+		t.Errorf("chat Tokens = %v, want 5", tokens)
+	}
+}
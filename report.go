@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	TgReportPrivate  = "private"
+	TgReportLinks    = "links"
+	TgReportNewUsers = "newusers"
+	TgReportFailures = "failures"
+)
+
+var TgReportFilterNames = []string{TgReportPrivate, TgReportLinks, TgReportNewUsers, TgReportFailures}
+
+type chatAdmins struct {
+	admins []TgChatMember
+	time   time.Time
+}
+
+var (
+	ChatAdminsMutex sync.Mutex
+	ChatAdminsCache = map[int64]chatAdmins{}
+
+	ReportsMutex sync.Mutex
+	Reports      []string
+)
+
+func chatAdminsCached(chatid int64) ([]TgChatMember, bool) {
+	ChatAdminsMutex.Lock()
+	defer ChatAdminsMutex.Unlock()
+	ca, ok := ChatAdminsCache[chatid]
+	if !ok || time.Since(ca.time) > Config().TgChatAdminsCacheTtl {
+		return nil, false
+	}
+	return ca.admins, true
+}
+
+func chatAdminsCache(chatid int64, admins []TgChatMember) {
+	ChatAdminsMutex.Lock()
+	defer ChatAdminsMutex.Unlock()
+	now := time.Now()
+	for id, ca := range ChatAdminsCache {
+		if now.Sub(ca.time) > Config().TgChatAdminsCacheTtl {
+			delete(ChatAdminsCache, id)
+		}
+	}
+	ChatAdminsCache[chatid] = chatAdmins{admins: admins, time: now}
+}
+
+// reportMessage reports if the message should be sent to TgZeChatId, without TgReportFilters every message is.
+// With filters a message is reported if it matches any of them, failures are reported when they happen
+func reportMessage(m TgMessage, newuser bool) bool {
+	filters := Config().TgReportFilters
+	if len(filters) == 0 {
+		return true
+	}
+	if slices.Contains(filters, TgReportPrivate) && m.Chat.Type == "private" {
+		return true
+	}
+	if slices.Contains(filters, TgReportNewUsers) && newuser {
+		return true
+	}
+	if slices.Contains(filters, TgReportLinks) && (Config().YtReRegexp.MatchString(m.Text) || Config().YtListReRegexp.MatchString(m.Text)) {
+		return true
+	}
+	return false
+}
+
+// reportNewUser remembers the user and reports if it was not seen before,
+// the users are kept in the state only while the newusers filter is set
+func reportNewUser(userid int64) bool {
+	if userid == 0 || !slices.Contains(Config().TgReportFilters, TgReportNewUsers) {
+		return false
+	}
+	StateMutex.Lock()
+	_, known := slices.BinarySearch(State.TgKnownUserIds, userid)
+	StateMutex.Unlock()
+	if known {
+		return false
+	}
+	err := stateUpdate(func(state *TgZeState) {
+		if i, known := slices.BinarySearch(state.TgKnownUserIds, userid); !known {
+			state.TgKnownUserIds = slices.Insert(state.TgKnownUserIds, i, userid)
+		}
+	})
+	if err != nil {
+		log("ERROR stateUpdate: %v", err)
+	}
+	return true
+}
+
+// reportFailure reports the failed request if the failures filter is set
+func reportFailure(m TgMessage, failure error) {
+	if !slices.Contains(Config().TgReportFilters, TgReportFailures) {
+		return
+	}
+	tgreport(fmt.Sprintf(
+		"*Failure*"+NL+
+			"from: username:@%s id:`%d`"+NL+
+			"chat: id:`%d` username:@%s type:%s title:%s"+NL+
+			"text:"+NL+
+			"```"+NL+
+			"%s"+NL+
+			"```"+NL+
+			"error:"+NL+
+			"```"+NL+
+			"%s"+NL+
+			"```",
+		m.From.Username, m.From.Id,
+		m.Chat.Id, m.Chat.Username, m.Chat.Type, tgescape(m.Chat.Title),
+		m.Text,
+		failure,
+	))
+}
+
+// tgreport sends the MarkdownV2 report to TgZeChatId, with TgReportBatchInterval the reports are collected and sent together
+func tgreport(report string) {
+	if Config().TgReportBatchInterval <= 0 {
+		if _, err := tgsendMessage(report, Config().TgZeChatId, "MarkdownV2", 0); err != nil {
+			log("tgsendMessage: %v", err)
+		}
+		return
+	}
+	ReportsMutex.Lock()
+	Reports = append(Reports, report)
+	ReportsMutex.Unlock()
+}
+
+// reportsLoop sends the collected reports every TgReportBatchInterval in as few messages as fit the telegram limit
+func reportsLoop() {
+	for {
+		interval := Config().TgReportBatchInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		time.Sleep(interval)
+
+		ReportsMutex.Lock()
+		reports := Reports
+		Reports = nil
+		ReportsMutex.Unlock()
+
+		for _, text := range tgtextBatches(reports) {
+			if _, err := tgsendMessage(text, Config().TgZeChatId, "MarkdownV2", 0); err != nil {
+				log("tgsendMessage: %v", err)
+			}
+		}
+	}
+}
+
+// TgTextMaxSize is a bit under the limit of a message text
+// https://core.telegram.org/bots/api#sendmessage text is 1-4096 characters
+const TgTextMaxSize = 4000
+
+// tgtextBatches joins the parts with empty lines in as few texts as fit TgTextMaxSize, a longer part is cut
+func tgtextBatches(parts []string) (texts []string) {
+	var batch []string
+	var size int
+	for _, p := range parts {
+		if len(p) > TgTextMaxSize {
+			p = strings.ToValidUTF8(p[:TgTextMaxSize-len("…")], "") + "…"
+		}
+		if len(batch) > 0 && size+len(p) > TgTextMaxSize {
+			texts = append(texts, strings.Join(batch, NL+NL))
+			batch, size = nil, 0
+		}
+		batch = append(batch, p)
+		size += len(p) + len(NL+NL)
+	}
+	if len(batch) > 0 {
+		texts = append(texts, strings.Join(batch, NL+NL))
+	}
+	return texts
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTgtextBatches(t *testing.T) {
+	short := strings.Repeat("a", 1000)
+	long := strings.Repeat("я", TgTextMaxSize)
+	for _, tt := range []struct {
+		name  string
+		parts []string
+		sizes []int
+	}{
+		{"none", nil, nil},
+		{"one", []string{"a"}, []int{1}},
+		{"joined", []string{"a", "b"}, []int{4}},
+		{"three fit", []string{short, short, short}, []int{3004}},
+		{"four fit", []string{short, short, short, short[:994]}, []int{4000}},
+		{"split", []string{short, short, short, short}, []int{3004, 1000}},
+		{"cut", []string{"a", long, "b"}, []int{1, TgTextMaxSize - 1, 1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			texts := tgtextBatches(tt.parts)
+			var sizes []int
+			for _, text := range texts {
+				if !utf8.ValidString(text) {
+					t.Errorf("text is not valid utf8")
+				}
+				sizes = append(sizes, len(text))
+			}
+			if !slices.Equal(sizes, tt.sizes) {
+				t.Errorf("sizes = %v, want %v", sizes, tt.sizes)
+			}
+		})
+	}
+}
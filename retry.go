@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ytdl "github.com/kkdai/youtube/v2"
+)
+
+// backoff is the wait before the attempt, it doubles from RetryBackoffMin up to RetryBackoffMax
+// and is a random value from its half to the full so the retries of different jobs do not come together
+func backoff(attempt int) time.Duration {
+	lo, hi := Config().RetryBackoffMin, Config().RetryBackoffMax
+	d := hi
+	if n := attempt - 1; n < 32 && lo<<n < hi {
+		d = lo << n
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// sleepctx waits for the duration or until the context is done
+func sleepctx(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// RetriedError is a transient error that was already tried again up to YtRetries times,
+// the job does not retry it once more from the start
+type RetriedError struct {
+	Err error
+}
+
+func (e *RetriedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetriedError) Unwrap() error {
+	return e.Err
+}
+
+// ytretry calls f again after transient errors up to YtRetries times
+func ytretry(ctx context.Context, call string, f func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		MetricYoutubeError.Inc(call)
+		class := errclass(err)
+		if !errretry(class) {
+			return err
+		}
+		if attempt > Config().YtRetries {
+			if attempt > 1 {
+				return &RetriedError{Err: err}
+			}
+			return err
+		}
+		delay := backoff(attempt)
+		logctx(ctx, "WARNING %s %s: %v, retrying in %v attempt:%d", call, class, err, delay, attempt)
+		if err := sleepctx(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// YtStream reads the stream url with range requests of YtChunkSizeBytes,
+// after a transient error it reconnects with the range from the offset it has read to
+type YtStream struct {
+	Size int64
+
+	ctx    context.Context
+	ytdl   *ytdl.Client
+	url    string
+	offset int64
+	body   io.ReadCloser
+	// end is the offset where the current response ends, zero if it goes to the end of the stream
+	end      int64
+	attempts int
+}
+
+// ytstreamOpen gets the stream url and starts the download, Size is zero if neither the format nor the response tell it
+func ytstreamOpen(ctx context.Context, client *ytdl.Client, vinfo *ytdl.Video, format *ytdl.Format) (*YtStream, error) {
+	s := &YtStream{Size: format.ContentLength, ctx: ctx, ytdl: client}
+	err := ytretry(ctx, "GetStreamURLContext", func() (err error) {
+		s.url, err = client.GetStreamURLContext(ctx, vinfo, format)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetStreamURLContext: %w", err)
+	}
+	if err := s.reconnect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *YtStream) Read(p []byte) (n int, err error) {
+	for {
+		if s.body == nil {
+			if s.Size > 0 && s.offset >= s.Size {
+				return 0, io.EOF
+			}
+			if err := s.reconnect(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err = s.body.Read(p)
+		s.offset += int64(n)
+		if n > 0 {
+			s.attempts = 0
+		}
+		if err == nil {
+			return n, nil
+		}
+
+		s.body.Close()
+		s.body = nil
+		if err == io.EOF {
+			if s.end == 0 || (s.Size > 0 && s.offset >= s.Size) {
+				return n, io.EOF
+			}
+			if s.offset < s.end && s.Size == 0 {
+				// without the size a short chunk is the end of the stream
+				return n, io.EOF
+			}
+			if s.offset < s.end {
+				err = io.ErrUnexpectedEOF
+			} else if n > 0 {
+				// the next chunk is requested on the next read
+				return n, nil
+			} else {
+				continue
+			}
+		}
+
+		if n > 0 {
+			// the next read reconnects from the offset
+			return n, nil
+		}
+		class := errclass(err)
+		s.attempts++
+		if s.ctx.Err() != nil || !errretry(class) {
+			return 0, err
+		}
+		if s.attempts > Config().YtRetries {
+			if s.attempts > 1 {
+				return 0, &RetriedError{Err: err}
+			}
+			return 0, err
+		}
+		delay := backoff(s.attempts)
+		logctx(s.ctx, "WARNING download %s at %dmb: %v, resuming in %v attempt:%d", class, s.offset>>20, err, delay, s.attempts)
+		if err := sleepctx(s.ctx, delay); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// reconnect requests the next chunk from the offset, transient errors of the request are retried
+func (s *YtStream) reconnect() error {
+	err := ytretry(s.ctx, "GetStream", func() error {
+		end := s.offset + Config().YtChunkSizeBytes
+		if s.Size > 0 && end > s.Size {
+			end = s.Size
+		}
+		req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, s.url, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", s.offset, end-1))
+
+		client := s.ytdl.HTTPClient
+		if client == nil {
+			client = http.DefaultClient
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			// Content-Range is like `bytes 0-1023/4096`
+			if _, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/"); ok && s.Size == 0 {
+				s.Size, _ = strconv.ParseInt(total, 10, 64)
+			}
+			if s.Size > 0 && end > s.Size {
+				end = s.Size
+			}
+			s.body, s.end = resp.Body, end
+		case http.StatusOK:
+			// the server ignored the range so the part already read is skipped
+			if s.Size == 0 && resp.ContentLength > 0 {
+				s.Size = resp.ContentLength
+			}
+			if _, err := io.CopyN(io.Discard, resp.Body, s.offset); err != nil {
+				resp.Body.Close()
+				return err
+			}
+			s.body, s.end = resp.Body, 0
+		case http.StatusRequestedRangeNotSatisfiable:
+			resp.Body.Close()
+			if s.Size > 0 || s.offset == 0 {
+				return ytdl.ErrUnexpectedStatusCode(resp.StatusCode)
+			}
+			// without the size the stream that ends at a chunk boundary ends with a range after it
+			s.Size = s.offset
+			s.body, s.end = http.NoBody, 0
+		default:
+			resp.Body.Close()
+			return ytdl.ErrUnexpectedStatusCode(resp.StatusCode)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("GetStream at %dmb: %w", s.offset>>20, err)
+	}
+	return nil
+}
+
+func (s *YtStream) Close() error {
+	if s.body == nil {
+		return nil
+	}
+	err := s.body.Close()
+	s.body = nil
+	return err
+}
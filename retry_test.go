@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ytdl "github.com/kkdai/youtube/v2"
+)
+
+// testConfig sets the config with the defaults and the changes for the time of the test
+func testConfig(t *testing.T, change func(config *TgZeConfig)) {
+	t.Helper()
+	config := &TgZeConfig{}
+	config.SetDefaults()
+	if change != nil {
+		change(config)
+	}
+	old := ConfigPtr.Load()
+	ConfigPtr.Store(config)
+	t.Cleanup(func() { ConfigPtr.Store(old) })
+}
+
+func TestBackoff(t *testing.T) {
+	testConfig(t, func(config *TgZeConfig) {
+		config.RetryBackoffMin, config.RetryBackoffMax = time.Second, 10*time.Second
+	})
+	for attempt, full := range map[int]time.Duration{
+		1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 8 * time.Second,
+		5: 10 * time.Second, 40: 10 * time.Second, 100: 10 * time.Second,
+	} {
+		for range 20 {
+			if d := backoff(attempt); d < full/2 || d > full {
+				t.Errorf("backoff(%d) = %v, want from %v to %v", attempt, d, full/2, full)
+			}
+		}
+	}
+}
+
+// ytstreamServer serves data with the range requests like youtube, respond can change the response to the range from offset
+type ytstreamServer struct {
+	data     []byte
+	size     string
+	requests atomic.Int32
+	respond  func(w http.ResponseWriter, offset, end int64) bool
+}
+
+func (s *ytstreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := s.requests.Add(1)
+	if n > 100 {
+		http.Error(w, "too many requests in the test", http.StatusBadRequest)
+		return
+	}
+
+	var offset, end int64
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &offset, &end); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	end = min(end+1, int64(len(s.data)))
+	if s.respond != nil && s.respond(w, offset, end) {
+		return
+	}
+	if offset >= int64(len(s.data)) {
+		w.Header().Set("Content-Range", "bytes */"+s.size)
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", offset, end-1, s.size))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-offset, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(s.data[offset:end])
+}
+
+// testYtStream opens the stream of the server like ytstreamOpen after it got the stream url
+func testYtStream(t *testing.T, server *ytstreamServer, size int64) (*YtStream, error) {
+	t.Helper()
+	httpserver := httptest.NewServer(server)
+	t.Cleanup(httpserver.Close)
+
+	s := &YtStream{
+		Size: size,
+		ctx:  context.Background(),
+		ytdl: &ytdl.Client{HTTPClient: httpserver.Client()},
+		url:  httpserver.URL,
+	}
+	if err := s.reconnect(); err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, nil
+}
+
+func TestYtStream(t *testing.T) {
+	const chunk = 1000
+	data := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 150)
+	boundary := data[:5*chunk]
+
+	for _, tt := range []struct {
+		name    string
+		data    []byte
+		size    string
+		known   bool
+		respond func(w http.ResponseWriter, offset, end int64) bool
+	}{
+		{name: "ranges", data: data, size: strconv.Itoa(len(data)), known: true},
+		{name: "size from the response", data: data, size: strconv.Itoa(len(data))},
+		{name: "unknown size", data: data, size: "*"},
+		{name: "eof at a chunk boundary", data: boundary, size: strconv.Itoa(len(boundary)), known: true},
+		{name: "eof at a chunk boundary with unknown size", data: boundary, size: "*"},
+		{
+			name: "short chunks", data: data, size: strconv.Itoa(len(data)), known: true,
+			respond: func(w http.ResponseWriter, offset, end int64) bool {
+				// the connection drops after a part of the chunk
+				short := min(offset+300, end)
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, len(data)))
+				w.Header().Set("Content-Length", strconv.FormatInt(end-offset, 10))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(data[offset:short])
+				return true
+			},
+		},
+		{
+			name: "200 instead of 206", data: data, size: strconv.Itoa(len(data)),
+			respond: func(w http.ResponseWriter, offset, end int64) bool {
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.WriteHeader(http.StatusOK)
+				w.Write(data)
+				return true
+			},
+		},
+		{
+			name: "200 after a drop", data: data, size: strconv.Itoa(len(data)), known: true,
+			respond: func(w http.ResponseWriter, offset, end int64) bool {
+				if offset == 0 {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, len(data)))
+					w.Header().Set("Content-Length", strconv.FormatInt(end-offset, 10))
+					w.WriteHeader(http.StatusPartialContent)
+					w.Write(data[offset : offset+100])
+					return true
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.WriteHeader(http.StatusOK)
+				w.Write(data)
+				return true
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig(t, func(config *TgZeConfig) {
+				config.YtChunkSizeBytes = chunk
+				config.RetryBackoffMin, config.RetryBackoffMax = time.Millisecond, time.Millisecond
+			})
+			var size int64
+			if tt.known {
+				size = int64(len(tt.data))
+			}
+			s, err := testYtStream(t, &ytstreamServer{data: tt.data, size: tt.size, respond: tt.respond}, size)
+			if err != nil {
+				t.Fatalf("reconnect: %v", err)
+			}
+			got, err := io.ReadAll(s)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("read %d bytes, want %d bytes of the data", len(got), len(tt.data))
+			}
+			if tt.size != "*" && s.Size != int64(len(tt.data)) {
+				t.Errorf("Size = %d, want %d", s.Size, len(tt.data))
+			}
+		})
+	}
+}
+
+func TestYtStreamGivesUp(t *testing.T) {
+	testConfig(t, func(config *TgZeConfig) {
+		config.YtChunkSizeBytes = 1000
+		config.YtRetries = 2
+		config.RetryBackoffMin, config.RetryBackoffMax = time.Millisecond, time.Millisecond
+	})
+	data := bytes.Repeat([]byte("x"), 3000)
+	server := &ytstreamServer{
+		data: data, size: "3000",
+		respond: func(w http.ResponseWriter, offset, end int64) bool {
+			if offset == 0 {
+				return false
+			}
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return true
+		},
+	}
+	s, err := testYtStream(t, server, 3000)
+	if err != nil {
+		t.Fatalf("reconnect: %v", err)
+	}
+	got, err := io.ReadAll(s)
+	if len(got) != 1000 {
+		t.Errorf("read %d bytes, want 1000", len(got))
+	}
+	if errclass(err) != ErrClassTransient || !strings.Contains(err.Error(), "503") {
+		t.Errorf("ReadAll error = %v, want the transient 503", err)
+	}
+	// the first chunk and the first try with 2 retries of the second one
+	if n := server.requests.Load(); n != 4 {
+		t.Errorf("requests = %d, want 4", n)
+	}
+}
+
+func TestYtretry(t *testing.T) {
+	testConfig(t, func(config *TgZeConfig) {
+		config.YtRetries = 2
+		config.RetryBackoffMin, config.RetryBackoffMax = time.Millisecond, time.Millisecond
+	})
+	ctx := context.Background()
+
+	var calls int
+	err := ytretry(ctx, "test", func() error {
+		calls++
+		if calls < 3 {
+			return ytdl.ErrUnexpectedStatusCode(503)
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("ytretry = %v after %d calls, want nil after 3", err, calls)
+	}
+
+	calls = 0
+	err = ytretry(ctx, "test", func() error {
+		calls++
+		return ytdl.ErrUnexpectedStatusCode(503)
+	})
+	var retried *RetriedError
+	if !errors.As(err, &retried) || calls != 3 {
+		t.Errorf("ytretry = %v after %d calls, want RetriedError after 3", err, calls)
+	}
+
+	calls = 0
+	err = ytretry(ctx, "test", func() error {
+		calls++
+		return ytdl.ErrUnexpectedStatusCode(404)
+	})
+	if errors.As(err, &retried) || calls != 1 {
+		t.Errorf("ytretry = %v after %d calls, want the error after 1", err, calls)
+	}
+
+	// a negative YtRetries disables the retries
+	testConfig(t, func(config *TgZeConfig) { config.YtRetries = -1 })
+	calls = 0
+	err = ytretry(ctx, "test", func() error {
+		calls++
+		return ytdl.ErrUnexpectedStatusCode(503)
+	})
+	if errors.As(err, &retried) || calls != 1 {
+		t.Errorf("ytretry = %v after %d calls, want the error after 1", err, calls)
+	}
+}
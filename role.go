@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+type Role int
+
+const (
+	RoleUser Role = iota
+	RoleModerator
+	RoleAdmin
+	RoleOwner
+)
+
+var RoleNames = []string{"user", "moderator", "admin", "owner"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(RoleNames) {
+		return fmt.Sprintf("role%d", int(r))
+	}
+	return RoleNames[r]
+}
+
+func parseRole(s string) (Role, error) {
+	i := slices.Index(RoleNames, s)
+	if i < 0 {
+		return 0, fmt.Errorf("unknown role %s, should be one of %s", s, strings.Join(RoleNames, " "))
+	}
+	return Role(i), nil
+}
+
+// roleOf returns the role of the user, TgZeChatId is always the owner and TgAdminIds are at least admins
+func roleOf(userid int64) Role {
+	if userid == 0 {
+		return RoleUser
+	}
+	if userid == Config().TgZeChatId {
+		return RoleOwner
+	}
+
+	StateMutex.Lock()
+	role, err := parseRole(State.TgRoles[userid])
+	StateMutex.Unlock()
+	if err != nil {
+		role = RoleUser
+	}
+
+	if slices.Contains(Config().TgAdminIds, userid) && role < RoleAdmin {
+		role = RoleAdmin
+	}
+	return role
+}
+
+func roleAllowed(userid int64, role Role) bool {
+	return roleOf(userid) >= role
+}
+
+// roleDenied replies to a privileged command sent by a user without the role and writes it to the audit log
+func roleDenied(m TgMessage, command string, role Role) {
+	log("role denied from:`%s` id:%d chat:%d command:%s", m.From.Username, m.From.Id, m.Chat.Id, command)
+	audit(m, command, "denied", fmt.Sprintf("needs role %s", role))
+	_, err := tgsendMessage(fmt.Sprintf("this command is only for the bot %ss", role), m.Chat.Id, "", m.MessageId)
+	if err != nil {
+		log("tgsendMessage: %v", err)
+	}
+}
+
+// processTgRoleCommand handles `/role` to list the roles and `/role <user id> <role>` to set one, only for the owners
+func processTgRoleCommand(m TgMessage) bool {
+	ff := strings.Fields(m.Text)
+	if len(ff) == 0 {
+		return false
+	}
+	if cmd, _, _ := strings.Cut(ff[0], "@"); cmd != "/role" {
+		return false
+	}
+
+	if !roleAllowed(m.From.Id, RoleOwner) {
+		roleDenied(m, "/role", RoleOwner)
+		return true
+	}
+
+	var reply string
+	switch len(ff) {
+	case 1:
+		reply = roleList()
+	case 3:
+		userid, err := strconv.ParseInt(ff[1], 10, 64)
+		if err != nil {
+			reply = fmt.Sprintf("ERROR invalid user id %s", ff[1])
+			break
+		}
+		role, err := parseRole(ff[2])
+		if err != nil {
+			reply = fmt.Sprintf("ERROR %v", err)
+			break
+		}
+		err = stateUpdate(func(state *TgZeState) {
+			if state.TgRoles == nil {
+				state.TgRoles = make(map[int64]string)
+			}
+			if role == RoleUser {
+				delete(state.TgRoles, userid)
+			} else {
+				state.TgRoles[userid] = role.String()
+			}
+		})
+		if err != nil {
+			reply = fmt.Sprintf("ERROR stateUpdate: %v", err)
+			break
+		}
+		log("role of %d set to %s by %d", userid, role, m.From.Id)
+		audit(m, "/role", "ok", fmt.Sprintf("user %d role %s", userid, role))
+		reply = fmt.Sprintf("user %d is %s now", userid, roleOf(userid))
+	default:
+		reply = "usage: /role [<user id> " + strings.Join(RoleNames, "|") + "]"
+	}
+
+	if _, err := tgsendMessage(reply, m.Chat.Id, "", m.MessageId); err != nil {
+		log("tgsendMessage: %v", err)
+	}
+	return true
+}
+
+func roleList() string {
+	lines := []string{fmt.Sprintf("%d owner (TgZeChatId)", Config().TgZeChatId)}
+	for _, id := range Config().TgAdminIds {
+		lines = append(lines, fmt.Sprintf("%d admin (TgAdminIds)", id))
+	}
+
+	StateMutex.Lock()
+	var ids []int64
+	for id := range State.TgRoles {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		lines = append(lines, fmt.Sprintf("%d %s", id, State.TgRoles[id]))
+	}
+	StateMutex.Unlock()
+
+	return strings.Join(lines, NL)
+}
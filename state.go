@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// TgZeState is the document the bot changes itself, it is kept apart from the config written by the operator
+type TgZeState struct {
+	StateUrl string `yaml:"-"`
+	Store    Store  `yaml:"-"`
+	Version  string `yaml:"-"`
+
+	// the api server the bot is logged in to, a change of TgApiUrlBase means a migration
+	TgApiUrlBase string `yaml:"TgApiUrlBase"`
+
+	// TgUpdateOffset is the next update id to get, TgUpdateIds are the recently processed ids
+	// as ranges so a few numbers cover thousands of sequential ids
+	TgUpdateOffset int64            `yaml:"TgUpdateOffset"`
+	TgUpdateIds    TgUpdateIdRanges `yaml:"TgUpdateIds,flow"`
+
+	// TgUpdateLog is the list of ids of the old versions, it is converted to TgUpdateIds on load
+	TgUpdateLog []int64 `yaml:"TgUpdateLog,flow,omitempty"`
+
+	TgAllChannelsChatIds []int64 `yaml:"TgAllChannelsChatIds,flow"`
+
+	TgPostedVideos map[int64][]string `yaml:"TgPostedVideos"`
+
+	TgAccess TgZeAccess `yaml:"TgAccess"`
+
+	// TgRoles are the roles given with /role, users not in the map have the user role
+	TgRoles map[int64]string `yaml:"TgRoles"`
+
+	// TgKnownUserIds are sorted ids of the users who sent messages, for the newusers report filter
+	TgKnownUserIds []int64 `yaml:"TgKnownUserIds,flow"`
+
+	// TgDigestDay is the day the last daily digest was sent
+	TgDigestDay string `yaml:"TgDigestDay,omitempty"`
+
+	// TgAudit is the audit log if AuditPath is not set
+	TgAudit []AuditEntry `yaml:"TgAudit,omitempty"`
+
+	TgUserUsage map[int64]TgUsage `yaml:"TgUserUsage"`
+	TgChatUsage map[int64]TgUsage `yaml:"TgChatUsage"`
+}
+
+var (
+	State      TgZeState
+	StateMutex sync.Mutex
+)
+
+func (state *TgZeState) Get() error {
+	rbb, version, err := state.Store.Get()
+	if err != nil {
+		return err
+	}
+
+	var newstate TgZeState
+	if err := yaml.Unmarshal(rbb, &newstate); err != nil {
+		return err
+	}
+	newstate.StateUrl, newstate.Store, newstate.Version = state.StateUrl, state.Store, version
+	newstate.convertUpdateLog()
+	*state = newstate
+
+	if Config().DEBUG {
+		log("DEBUG State.Get %s version:%s", state.Store, state.Version)
+	}
+
+	return nil
+}
+
+func (state *TgZeState) Put() error {
+	if Config().DEBUG {
+		log("DEBUG State.Put %s version:%s", state.Store, state.Version)
+	}
+
+	rbb, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	t0 := time.Now()
+	state.Version, err = state.Store.Put(rbb, state.Version)
+	outcome := "ok"
+	if errors.Is(err, ErrStoreConflict) {
+		outcome = "conflict"
+	} else if err != nil {
+		outcome = "error"
+	}
+	MetricStorePutDuration.ObserveSince(t0, outcome)
+	return err
+}
+
+// stateInit loads the state, on the first start it is seeded from the fields of the old combined config document
+func stateInit() error {
+	StateMutex.Lock()
+	defer StateMutex.Unlock()
+
+	err := State.Get()
+	if errors.Is(err, ErrStoreNotFound) {
+		log("state %s not found, creating from the config document", State.Store)
+		configdata, _, err := Config().Store.Get()
+		if err != nil {
+			return fmt.Errorf("Config.Store.Get: %w", err)
+		}
+		if err := yaml.Unmarshal(configdata, &State); err != nil {
+			return fmt.Errorf("yaml.Unmarshal: %w", err)
+		}
+		// TgApiUrlBase of the config is where the bot should be, not where it is logged in
+		State.TgApiUrlBase = ""
+		State.convertUpdateLog()
+		return State.Put()
+	}
+	return err
+}
+
+// stateUpdate applies the change and saves the state, if someone else saved it in between
+// the change is applied again on top of the fresh document
+func stateUpdate(change func(state *TgZeState)) error {
+	StateMutex.Lock()
+	defer StateMutex.Unlock()
+
+	change(&State)
+
+	var err error
+	for try := 1; try <= 3; try++ {
+		err = State.Put()
+		if !errors.Is(err, ErrStoreConflict) {
+			return err
+		}
+		log("WARNING State.Put: %v, reloading the state try:%d", err, try)
+		if err := State.Get(); err != nil {
+			return fmt.Errorf("State.Get: %w", err)
+		}
+		change(&State)
+	}
+	return err
+}
+
+func (state *TgZeState) convertUpdateLog() {
+	for _, id := range state.TgUpdateLog {
+		state.TgUpdateIds = state.TgUpdateIds.Add(id)
+		state.TgUpdateOffset = max(state.TgUpdateOffset, id+1)
+	}
+	state.TgUpdateLog = nil
+}
+
+// TgUpdateIdRanges are sorted non-overlapping inclusive ranges of update ids
+type TgUpdateIdRanges [][2]int64
+
+func (rr TgUpdateIdRanges) Contains(id int64) bool {
+	i := sort.Search(len(rr), func(i int) bool { return rr[i][1] >= id })
+	return i < len(rr) && rr[i][0] <= id
+}
+
+func (rr TgUpdateIdRanges) Add(id int64) TgUpdateIdRanges {
+	i := sort.Search(len(rr), func(i int) bool { return rr[i][1] >= id-1 })
+	switch {
+	case i < len(rr) && rr[i][0] <= id && id <= rr[i][1]:
+		return rr
+	case i < len(rr) && rr[i][1] == id-1:
+		rr[i][1] = id
+		if i+1 < len(rr) && rr[i+1][0] == id+1 {
+			rr[i][1] = rr[i+1][1]
+			rr = slices.Delete(rr, i+1, i+2)
+		}
+		return rr
+	case i < len(rr) && rr[i][0] == id+1:
+		rr[i][0] = id
+		return rr
+	}
+	return slices.Insert(rr, i, [2]int64{id, id})
+}
+
+// Trim drops the oldest ids so not more than maxsize ids are kept
+func (rr TgUpdateIdRanges) Trim(maxsize int64) TgUpdateIdRanges {
+	var size int64
+	for i := len(rr) - 1; i >= 0; i-- {
+		n := rr[i][1] - rr[i][0] + 1
+		if size+n > maxsize {
+			if size == maxsize {
+				// the newer ranges have all the ids to keep
+				return rr[i+1:]
+			}
+			rr[i][0] += size + n - maxsize
+			return rr[i:]
+		}
+		size += n
+	}
+	return rr
+}
+
+// TgUpdatesHandled are the update ids handled since the start, telegram sends the updates again
+// if the write of their batch failed and these are not handled twice
+var TgUpdatesHandled TgUpdateIdRanges
+
+// stateNewUpdates returns the updates not processed yet
+func stateNewUpdates(uu []TgUpdate) (newuu []TgUpdate) {
+	StateMutex.Lock()
+	defer StateMutex.Unlock()
+	for _, u := range uu {
+		if State.TgUpdateIds.Contains(u.UpdateId) || TgUpdatesHandled.Contains(u.UpdateId) {
+			log("WARNING this telegram update id:%d was already processed, skipping", u.UpdateId)
+			continue
+		}
+		newuu = append(newuu, u)
+	}
+	return newuu
+}
+
+// stateHandled remembers the update id in memory before the update is handled
+func stateHandled(id int64) {
+	maxsize := int64(Config().TgUpdateLogMaxSize)
+	StateMutex.Lock()
+	defer StateMutex.Unlock()
+	TgUpdatesHandled = TgUpdatesHandled.Add(id).Trim(maxsize)
+}
+
+// stateConfirmUpdates saves the processed ids and the next offset in one write for the whole batch.
+// It is called after the batch is handled so a crash in between repeats the batch after the restart
+// rather than loses it, the ids already saved are skipped then
+func stateConfirmUpdates(uu []TgUpdate) error {
+	if len(uu) == 0 {
+		return nil
+	}
+	maxsize := int64(Config().TgUpdateLogMaxSize)
+	return stateUpdate(func(state *TgZeState) {
+		for _, u := range uu {
+			state.TgUpdateIds = state.TgUpdateIds.Add(u.UpdateId)
+			state.TgUpdateOffset = max(state.TgUpdateOffset, u.UpdateId+1)
+		}
+		state.TgUpdateIds = state.TgUpdateIds.Trim(maxsize)
+	})
+}
+
+func statePosted(chatid int64, videoid string) bool {
+	StateMutex.Lock()
+	defer StateMutex.Unlock()
+	return slices.Contains(State.TgPostedVideos[chatid], videoid)
+}
+
+func statePostedAdd(chatid int64, videoid string) {
+	maxsize := Config().TgPostedVideosMaxSize
+	err := stateUpdate(func(state *TgZeState) {
+		if state.TgPostedVideos == nil {
+			state.TgPostedVideos = make(map[int64][]string)
+		}
+		posted := slices.DeleteFunc(state.TgPostedVideos[chatid], func(id string) bool { return id == videoid })
+		posted = append(posted, videoid)
+		if len(posted) > maxsize {
+			posted = posted[len(posted)-maxsize:]
+		}
+		state.TgPostedVideos[chatid] = posted
+	})
+	if err != nil {
+		log("ERROR stateUpdate: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testState sets an empty state in a memory store for the time of the test
+func testState(t *testing.T) {
+	t.Helper()
+	StateMutex.Lock()
+	old := State
+	State = TgZeState{Store: NewMemStore(t.Name())}
+	StateMutex.Unlock()
+	t.Cleanup(func() {
+		StateMutex.Lock()
+		State = old
+		StateMutex.Unlock()
+	})
+}
+
+func TestTgUpdateIdRangesAdd(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		rr   TgUpdateIdRanges
+		id   int64
+		want TgUpdateIdRanges
+	}{
+		{"empty", nil, 5, TgUpdateIdRanges{{5, 5}}},
+		{"inside", TgUpdateIdRanges{{3, 7}}, 5, TgUpdateIdRanges{{3, 7}}},
+		{"at the start", TgUpdateIdRanges{{3, 7}}, 3, TgUpdateIdRanges{{3, 7}}},
+		{"at the end", TgUpdateIdRanges{{3, 7}}, 7, TgUpdateIdRanges{{3, 7}}},
+		{"extends the end", TgUpdateIdRanges{{3, 7}}, 8, TgUpdateIdRanges{{3, 8}}},
+		{"extends the start", TgUpdateIdRanges{{3, 7}}, 2, TgUpdateIdRanges{{2, 7}}},
+		{"before", TgUpdateIdRanges{{3, 7}}, 1, TgUpdateIdRanges{{1, 1}, {3, 7}}},
+		{"after", TgUpdateIdRanges{{3, 7}}, 9, TgUpdateIdRanges{{3, 7}, {9, 9}}},
+		{"between", TgUpdateIdRanges{{1, 2}, {8, 9}}, 5, TgUpdateIdRanges{{1, 2}, {5, 5}, {8, 9}}},
+		{"joins two", TgUpdateIdRanges{{1, 4}, {6, 9}}, 5, TgUpdateIdRanges{{1, 9}}},
+		{"extends the second", TgUpdateIdRanges{{1, 2}, {6, 9}}, 5, TgUpdateIdRanges{{1, 2}, {5, 9}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := append(TgUpdateIdRanges(nil), tt.rr...)
+			if got := rr.Add(tt.id); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%v.Add(%d) = %v, want %v", tt.rr, tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTgUpdateIdRangesContains(t *testing.T) {
+	rr := TgUpdateIdRanges{{3, 5}, {9, 9}, {12, 20}}
+	for id, want := range map[int64]bool{
+		1: false, 3: true, 4: true, 5: true, 6: false, 8: false,
+		9: true, 10: false, 12: true, 20: true, 21: false,
+	} {
+		if got := rr.Contains(id); got != want {
+			t.Errorf("%v.Contains(%d) = %v, want %v", rr, id, got, want)
+		}
+	}
+	if TgUpdateIdRanges(nil).Contains(1) {
+		t.Errorf("empty ranges contain 1")
+	}
+}
+
+func TestTgUpdateIdRangesTrim(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		rr      TgUpdateIdRanges
+		maxsize int64
+		want    TgUpdateIdRanges
+	}{
+		{"empty", nil, 10, nil},
+		{"under the size", TgUpdateIdRanges{{1, 3}, {5, 6}}, 10, TgUpdateIdRanges{{1, 3}, {5, 6}}},
+		{"exactly the size", TgUpdateIdRanges{{1, 3}, {5, 6}}, 5, TgUpdateIdRanges{{1, 3}, {5, 6}}},
+		{"cuts the first range", TgUpdateIdRanges{{1, 3}, {5, 6}}, 4, TgUpdateIdRanges{{2, 3}, {5, 6}}},
+		{"drops the first range", TgUpdateIdRanges{{1, 3}, {5, 6}}, 2, TgUpdateIdRanges{{5, 6}}},
+		{"cuts the last range", TgUpdateIdRanges{{1, 3}, {5, 10}}, 2, TgUpdateIdRanges{{9, 10}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := append(TgUpdateIdRanges(nil), tt.rr...)
+			if got := rr.Trim(tt.maxsize); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%v.Trim(%d) = %v, want %v", tt.rr, tt.maxsize, got, tt.want)
+			}
+		})
+	}
+}
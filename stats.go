@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stats are the totals of the downloads in the audit log over a period
+type Stats struct {
+	Downloads  int
+	ByMedia    map[string]int
+	Failures   map[string]int
+	Users      map[int64]int
+	Chats      map[int64]int
+	Videos     map[string]int
+	Bytes      int64
+	Transcoded int
+}
+
+func statsCompute(ee []AuditEntry, since time.Time) *Stats {
+	st := &Stats{
+		ByMedia:  map[string]int{},
+		Failures: map[string]int{},
+		Users:    map[int64]int{},
+		Chats:    map[int64]int{},
+		Videos:   map[string]int{},
+	}
+	for _, e := range ee {
+		if e.Time.Before(since) {
+			continue
+		}
+		if e.Command != "audio" && e.Command != "video" && e.Command != "raw" {
+			continue
+		}
+		if e.Outcome == "error" {
+			cause := string(e.Class)
+			if cause == "" {
+				cause = statsCause(e.Details)
+			}
+			st.Failures[cause]++
+			continue
+		}
+		if e.Outcome != "ok" {
+			continue
+		}
+		st.Downloads++
+		st.ByMedia[e.Command]++
+		if e.UserId != 0 {
+			st.Users[e.UserId]++
+		}
+		st.Chats[e.ChatId]++
+		for _, id := range e.VideoIds {
+			st.Videos[id]++
+		}
+		st.Bytes += e.Bytes
+		if strings.Contains(e.Format, "transcoded") {
+			st.Transcoded++
+		}
+	}
+	return st
+}
+
+// statsCause is the part of the error before the first colon, for the entries without the error class
+func statsCause(details string) string {
+	cause, _, _ := strings.Cut(details, ":")
+	if cause == "" {
+		cause = "unknown"
+	}
+	return cause
+}
+
+// statsTop returns the keys with the biggest counts like `key count, key count`
+func statsTop[K comparable](m map[K]int, n int, format func(K) string) string {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]] != m[keys[j]] {
+			return m[keys[i]] > m[keys[j]]
+		}
+		return format(keys[i]) < format(keys[j])
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	var ss []string
+	for _, k := range keys {
+		ss = append(ss, fmt.Sprintf("%s %d", format(k), m[k]))
+	}
+	if len(ss) == 0 {
+		return "none"
+	}
+	return strings.Join(ss, ", ")
+}
+
+func (st *Stats) String() string {
+	var failures int
+	for _, n := range st.Failures {
+		failures += n
+	}
+	var transcoded int
+	if st.Downloads > 0 {
+		transcoded = st.Transcoded * 100 / st.Downloads
+	}
+	id := func(i int64) string { return fmt.Sprintf("%d", i) }
+	return fmt.Sprintf(
+		"downloads %d (audio %d video %d raw %d)"+NL+
+			"unique users %d"+NL+
+			"size %dmb"+NL+
+			"transcoded %d%%"+NL+
+			"failures %d: %s"+NL+
+			"top chats: %s"+NL+
+			"top videos: %s",
+		st.Downloads, st.ByMedia["audio"], st.ByMedia["video"], st.ByMedia["raw"],
+		len(st.Users),
+		st.Bytes>>20,
+		transcoded,
+		failures, statsTop(st.Failures, 5, func(s string) string { return s }),
+		statsTop(st.Chats, 5, id),
+		statsTop(st.Videos, 5, func(s string) string { return "youtu.be/" + s }),
+	)
+}
+
+// statsReport is the text of /stats and of the daily digest, it covers what is kept in the audit log
+func statsReport(periods ...time.Duration) (string, error) {
+	ee, err := auditRecent()
+	if err != nil {
+		return "", fmt.Errorf("auditRecent: %w", err)
+	}
+
+	now := time.Now()
+	var parts []string
+	for _, period := range periods {
+		name := "last day"
+		if period >= 7*24*time.Hour {
+			name = "last week"
+		}
+		parts = append(parts, name+":"+NL+statsCompute(ee, now.Add(-period)).String())
+	}
+	if len(ee) > 0 && ee[0].Time.After(now.Add(-periods[len(periods)-1])) {
+		parts = append(parts, fmt.Sprintf("(the audit log starts at %s)", ee[0].Time.UTC().Format("2006-01-02 15:04")))
+	}
+	return strings.Join(parts, NL+NL), nil
+}
+
+// processTgStatsCommand handles `/stats` for the bot admins
+func processTgStatsCommand(m TgMessage) bool {
+	ff := strings.Fields(m.Text)
+	if len(ff) == 0 {
+		return false
+	}
+	if cmd, _, _ := strings.Cut(ff[0], "@"); cmd != "/stats" {
+		return false
+	}
+
+	if !roleAllowed(m.From.Id, RoleAdmin) {
+		roleDenied(m, "/stats", RoleAdmin)
+		return true
+	}
+
+	reply, err := statsReport(24*time.Hour, 7*24*time.Hour)
+	if err != nil {
+		reply = fmt.Sprintf("ERROR %v", err)
+	}
+	if _, err := tgsendMessage(reply, m.Chat.Id, "", m.MessageId); err != nil {
+		log("tgsendMessage: %v", err)
+	}
+	return true
+}
+
+// digestLoop sends the stats of the last day to TgZeChatId every day at TgDigestTime utc,
+// the day of the last digest is kept in the state so a restart does not send it twice
+func digestLoop() {
+	for {
+		at := Config().TgDigestTime
+		if at == "" {
+			time.Sleep(time.Minute)
+			continue
+		}
+		clock, err := time.Parse("15:04", at)
+		if err != nil {
+			log("ERROR TgDigestTime `%s`: %v", at, err)
+			time.Sleep(time.Hour)
+			continue
+		}
+
+		now := time.Now().UTC()
+		next := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, time.UTC)
+		StateMutex.Lock()
+		sent := State.TgDigestDay == quotaDay(now)
+		StateMutex.Unlock()
+		if sent || now.Before(next) {
+			if !now.Before(next) {
+				next = next.Add(24 * time.Hour)
+			}
+			// sleep not more than a minute so a changed TgDigestTime is noticed
+			time.Sleep(min(time.Until(next), time.Minute))
+			continue
+		}
+
+		if err := stateUpdate(func(state *TgZeState) { state.TgDigestDay = quotaDay(now) }); err != nil {
+			log("ERROR stateUpdate: %v", err)
+		}
+
+		report, err := statsReport(24 * time.Hour)
+		if err != nil {
+			log("ERROR statsReport: %v", err)
+			continue
+		}
+		if _, err := tgsendMessage("daily digest"+NL+NL+report, Config().TgZeChatId, "", 0); err != nil {
+			log("tgsendMessage: %v", err)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Store keeps one yaml document, the implementation is chosen by the url scheme.
+// Get returns the version of the document and Put with a non-empty version fails
+// with ErrStoreConflict if the document was changed since that version was read.
+type Store interface {
+	Get() (data []byte, version string, err error)
+	Put(data []byte, version string) (newversion string, err error)
+	String() string
+}
+
+var (
+	ErrStoreNotFound = errors.New("not found")
+	ErrStoreConflict = errors.New("conflict")
+)
+
+func NewStore(url string) (Store, error) {
+	switch {
+	case strings.HasPrefix(url, "file://"):
+		path := strings.TrimPrefix(url, "file://")
+		if path == "" {
+			return nil, fmt.Errorf("empty path in `%s`", url)
+		}
+		return &FileStore{Path: path}, nil
+	case strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://"):
+		return &YssStore{Url: url}, nil
+	case strings.HasPrefix(url, "mem://"):
+		return NewMemStore(strings.TrimPrefix(url, "mem://")), nil
+	}
+	return nil, fmt.Errorf("unsupported store url `%s`, should be file://, http://, https:// or mem://", url)
+}
+
+type FileStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (s *FileStore) String() string {
+	return "file://" + s.Path
+}
+
+// the version of a file is the hash of its content so edits by hand are noticed as well
+func fileversion(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func (s *FileStore) Get() ([]byte, string, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", fmt.Errorf("%s: %w", s.Path, ErrStoreNotFound)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, fileversion(data), nil
+}
+
+// Put writes a temporary file next to the target and renames it so readers never see a partial document
+func (s *FileStore) Put(data []byte, version string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if version != "" {
+		current, err := os.ReadFile(s.Path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		if fileversion(current) != version {
+			return "", fmt.Errorf("%s: %w", s.Path, ErrStoreConflict)
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.Path), "."+filepath.Base(s.Path)+".")
+	if err != nil {
+		return "", fmt.Errorf("os.CreateTemp: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", fmt.Errorf("os.File.Write: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return "", fmt.Errorf("os.File.Sync: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("os.File.Close: %w", err)
+	}
+	if err := os.Rename(f.Name(), s.Path); err != nil {
+		return "", fmt.Errorf("os.Rename: %w", err)
+	}
+
+	return fileversion(data), nil
+}
+
+type YssStore struct {
+	Url string
+}
+
+func (s *YssStore) String() string {
+	return s.Url
+}
+
+func (s *YssStore) Get() ([]byte, string, error) {
+	req, err := http.NewRequest(http.MethodGet, s.Url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", fmt.Errorf("yss response status %s: %w", resp.Status, ErrStoreNotFound)
+	}
+	if resp.StatusCode != 200 {
+		return nil, "", fmt.Errorf("yss response status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, resp.Header.Get("ETag"), nil
+}
+
+// Put sends If-Match with the version so yss refuses to overwrite a document changed by someone else.
+// Without an ETag in the response the next Put is unconditional.
+func (s *YssStore) Put(data []byte, version string) (string, error) {
+	req, err := http.NewRequest(http.MethodPut, s.Url, bytes.NewBuffer(data))
+	if err != nil {
+		return "", err
+	}
+	if version != "" {
+		req.Header.Set("If-Match", version)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return "", fmt.Errorf("yss response status %s: %w", resp.Status, ErrStoreConflict)
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 201 && resp.StatusCode != 204 {
+		return "", fmt.Errorf("yss response status %s", resp.Status)
+	}
+
+	return resp.Header.Get("ETag"), nil
+}
+
+// MemStore keeps the document in memory, stores with the same name share it
+type MemStore struct {
+	Name string
+
+	mu      sync.Mutex
+	data    []byte
+	version int64
+}
+
+var (
+	MemStoresMutex sync.Mutex
+	MemStores      = map[string]*MemStore{}
+)
+
+func NewMemStore(name string) *MemStore {
+	MemStoresMutex.Lock()
+	defer MemStoresMutex.Unlock()
+	if s := MemStores[name]; s != nil {
+		return s
+	}
+	s := &MemStore{Name: name}
+	MemStores[name] = s
+	return s
+}
+
+func (s *MemStore) String() string {
+	return "mem://" + s.Name
+}
+
+func (s *MemStore) Get() ([]byte, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		return nil, "", fmt.Errorf("mem://%s: %w", s.Name, ErrStoreNotFound)
+	}
+	return bytes.Clone(s.data), strconv.FormatInt(s.version, 10), nil
+}
+
+func (s *MemStore) Put(data []byte, version string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version != "" && version != strconv.FormatInt(s.version, 10) {
+		return "", fmt.Errorf("mem://%s: %w", s.Name, ErrStoreConflict)
+	}
+	s.data = bytes.Clone(data)
+	s.version++
+	return strconv.FormatInt(s.version, 10), nil
+}
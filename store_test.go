@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreConflict(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		store func(t *testing.T) Store
+	}{
+		{"mem", func(t *testing.T) Store { return NewMemStore(t.Name()) }},
+		{"file", func(t *testing.T) Store { return &FileStore{Path: filepath.Join(t.TempDir(), "state.yaml")} }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.store(t)
+
+			if _, _, err := s.Get(); !errors.Is(err, ErrStoreNotFound) {
+				t.Fatalf("Get of a new store = %v, want ErrStoreNotFound", err)
+			}
+			if _, err := s.Put([]byte("a: 1\n"), ""); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			data, stale, err := s.Get()
+			if err != nil || string(data) != "a: 1\n" {
+				t.Fatalf("Get = %q %v, want the put data", data, err)
+			}
+			version, err := s.Put([]byte("a: 2\n"), stale)
+			if err != nil {
+				t.Fatalf("Put with the current version: %v", err)
+			}
+			if version == stale {
+				t.Errorf("Put returned the same version %s", version)
+			}
+
+			// another instance put a newer document since the stale version was read
+			if _, err := s.Put([]byte("a: 3\n"), stale); !errors.Is(err, ErrStoreConflict) {
+				t.Errorf("Put with a stale version = %v, want ErrStoreConflict", err)
+			}
+			data, current, err := s.Get()
+			if err != nil || string(data) != "a: 2\n" || current != version {
+				t.Errorf("Get after the conflict = %q %s %v, want the second document of version %s", data, current, err, version)
+			}
+
+			// an empty version overwrites the document without the check
+			if _, err := s.Put([]byte("a: 4\n"), ""); err != nil {
+				t.Errorf("Put without a version: %v", err)
+			}
+		})
+	}
+}
+
+func TestFileStoreEditedByHand(t *testing.T) {
+	s := &FileStore{Path: filepath.Join(t.TempDir(), "state.yaml")}
+	version, err := s.Put([]byte("a: 1\n"), "")
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := os.WriteFile(s.Path, []byte("a: 10\n"), 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if _, err := s.Put([]byte("a: 2\n"), version); !errors.Is(err, ErrStoreConflict) {
+		t.Errorf("Put over an edited file = %v, want ErrStoreConflict", err)
+	}
+}
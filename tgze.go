@@ -20,15 +20,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unicode"
@@ -43,21 +46,86 @@ const (
 	SPAC = "    "
 
 	BEAT = time.Duration(24) * time.Hour / 1000
+
+	TgApiCloudUrlBase = "https://api.telegram.org"
 )
 
 type TgZeConfig struct {
-	YssUrl string `yaml:"-"`
+	ConfigUrl string `yaml:"-"`
+	Store     Store  `yaml:"-"`
 
 	DEBUG bool `yaml:"DEBUG"`
 
+	// LogFormat is compact text or json, LogLevel is debug info warn or error, DEBUG sets the debug level as well
+	LogFormat string `yaml:"LogFormat"` // = "compact"
+	LogLevel  string `yaml:"LogLevel"`  // = "info"
+
 	Interval time.Duration `yaml:"Interval"`
 
 	TgApiUrlBase string `yaml:"TgApiUrlBase"` // = "https://api.telegram.org"
 
-	TgToken            string  `yaml:"TgToken"`
-	TgZeChatId         int64   `yaml:"TgZeChatId"`
-	TgUpdateLog        []int64 `yaml:"TgUpdateLog,flow"`
-	TgUpdateLogMaxSize int     `yaml:"TgUpdateLogMaxSize"` // = 1080
+	// https://github.com/tdlib/telegram-bot-api#moving-a-bot-to-a-local-server
+	// with TgApiLocal files are passed to the server as file:// paths so it has to see the same filesystem
+	TgApiLocal                 bool   `yaml:"TgApiLocal"`
+	TgApiLocalMaxFileSizeBytes int64  `yaml:"TgApiLocalMaxFileSizeBytes"` // = 2000 << 20
+	TgApiMigrateFromUrlBase    string `yaml:"TgApiMigrateFromUrlBase"`
+
+	TgToken            string `yaml:"TgToken"`
+	TgZeChatId         int64  `yaml:"TgZeChatId"`
+	TgUpdateLogMaxSize int    `yaml:"TgUpdateLogMaxSize"` // = 1080 recent update ids kept to skip duplicates
+
+	// in the open mode everyone not denied can download, in the allowlist mode only the allowed users and chats.
+	// the lists are changed by the bot admins with the /allow /deny /access commands
+	TgAccessMode string `yaml:"TgAccessMode"` // = "open"
+
+	// TgZeChatId is the owner, TgAdminIds are admins in addition to the roles given with /role
+	TgAdminIds []int64 `yaml:"TgAdminIds,flow"`
+
+	// limits for every user and every chat, TgQuotaChats overrides both for the users in the chat and the chat itself
+	TgQuotaUser  TgQuota           `yaml:"TgQuotaUser"`
+	TgQuotaChat  TgQuota           `yaml:"TgQuotaChat"`
+	TgQuotaChats map[int64]TgQuota `yaml:"TgQuotaChats"`
+
+	// the audit log is appended to AuditPath as json lines, without it the last AuditStateMaxSize entries are kept in the state
+	// where the new entries are saved together every AuditStateFlushInterval
+	AuditPath               string        `yaml:"AuditPath"`
+	AuditStateMaxSize       int           `yaml:"AuditStateMaxSize"`       // = 1000
+	AuditStateFlushInterval time.Duration `yaml:"AuditStateFlushInterval"` // = time.Minute
+
+	// HttpListenAddr serves /metrics /healthz /readyz, healthz fails if the main loop did not run for HealthHeartbeatMaxAge
+	HttpListenAddr        string        `yaml:"HttpListenAddr"`        // = ":8080"
+	HealthHeartbeatMaxAge time.Duration `yaml:"HealthHeartbeatMaxAge"` // = 10 * time.Minute
+
+	// with TgGetUpdatesBackoff the bot retries after transient getUpdates errors instead of exiting
+	TgGetUpdatesBackoff    bool          `yaml:"TgGetUpdatesBackoff"`
+	TgGetUpdatesBackoffMax time.Duration `yaml:"TgGetUpdatesBackoffMax"` // = 5 * time.Minute
+
+	// TgDigestTime like "09:00" utc sends the stats of the last day to TgZeChatId, empty disables the digest.
+	// TgReportMessagesDisabled stops the report of every message to TgZeChatId
+	TgDigestTime             string `yaml:"TgDigestTime"`
+	TgReportMessagesDisabled bool   `yaml:"TgReportMessagesDisabled"`
+
+	// TgReportFilters limits the reports to private, links, newusers and failures, any of them.
+	// with TgReportBatchInterval the reports are sent together once per interval
+	TgReportFilters       []string      `yaml:"TgReportFilters,flow"`
+	TgReportBatchInterval time.Duration `yaml:"TgReportBatchInterval"`
+	TgChatAdminsCacheTtl  time.Duration `yaml:"TgChatAdminsCacheTtl"` // = 10 * time.Minute
+
+	// JobRetries is how many times a video is tried again after a transient error, YtRetries is for every youtube request
+	// and every reconnect of a dropped download. a negative value disables the retries.
+	// the waits grow from RetryBackoffMin to RetryBackoffMax with jitter
+	JobRetries      int           `yaml:"JobRetries"`      // = 2
+	YtRetries       int           `yaml:"YtRetries"`       // = 3
+	RetryBackoffMin time.Duration `yaml:"RetryBackoffMin"` // = 2 * time.Second
+	RetryBackoffMax time.Duration `yaml:"RetryBackoffMax"` // = time.Minute
+
+	// every job keeps its files in its own dir in WorkDir, the dirs left by a crash are removed on the start.
+	// a download does not start if the disk would have less than WorkDirMinFreeBytes free after it
+	WorkDir             string `yaml:"WorkDir"`             // = "work"
+	WorkDirMinFreeBytes int64  `yaml:"WorkDirMinFreeBytes"` // = 100 << 20
+
+	// the stream is downloaded with range requests of YtChunkSizeBytes so a dropped connection continues from where it stopped
+	YtChunkSizeBytes int64 `yaml:"YtChunkSizeBytes"` // = 10 << 20
 
 	TgCommandChannels             string `yaml:"TgCommandChannels"`
 	TgCommandChannelsPromoteAdmin string `yaml:"TgCommandChannelsPromoteAdmin"`
@@ -69,17 +137,41 @@ type TgZeConfig struct {
 	TgQuest3    string `yaml:"TgQuest3"`
 	TgQuest3Key string `yaml:"TgQuest3Key"`
 
-	TgAllChannelsChatIds []int64 `yaml:"TgAllChannelsChatIds,flow"`
+	TgPostedVideosMaxSize int `yaml:"TgPostedVideosMaxSize"` // = 1000
+
+	TgProgressInterval time.Duration `yaml:"TgProgressInterval"` // = 3 * time.Second
 
 	TgMaxFileSizeBytes int64 `yaml:"TgMaxFileSizeBytes"` // = 47 << 20
+	TgRawSplitParts    bool  `yaml:"TgRawSplitParts"`
 	TgAudioBitrateKbps int64 `yaml:"TgAudioBitrateKbps"` // = 60
 
 	FfmpegPath          string   `yaml:"FfmpegPath"`          // = "/bin/ffmpeg"
 	FfmpegGlobalOptions []string `yaml:"FfmpegGlobalOptions"` // = []string{"-v", "error"}
 
+	// with FfmpegPipeline a transcoded download is piped into ffmpeg without writing the original to disk,
+	// with FfmpegPipelineUpload the fragmented mp4 from ffmpeg is uploaded as it is written, not with TgApiLocal.
+	// a streamed upload cannot be checked and encoded again so it targets the limit lowered by
+	// FfmpegPipelineUploadMarginPercent, telegram rejects the upload if the output is still over the limit
+	FfmpegPipeline                    bool  `yaml:"FfmpegPipeline"`
+	FfmpegPipelineUpload              bool  `yaml:"FfmpegPipelineUpload"`
+	FfmpegPipelineUploadMarginPercent int64 `yaml:"FfmpegPipelineUploadMarginPercent"` // = 10
+
+	// the transcoding targets the telegram limit with FfmpegOverheadPercent left for the container, an output
+	// over the limit is encoded again at a lower bitrate up to FfmpegSizeRetries times. the video is scaled down while its bitrate gives less than FfmpegMinBitsPerPixel,
+	// FfmpegTwoPass is only used when the original is on disk. a negative FfmpegOverheadPercent leaves no overhead and a negative FfmpegSizeRetries disables the retries
+	FfmpegOverheadPercent int64   `yaml:"FfmpegOverheadPercent"` // = 3
+	FfmpegSizeRetries     int     `yaml:"FfmpegSizeRetries"`     // = 2
+	FfmpegMinBitsPerPixel float64 `yaml:"FfmpegMinBitsPerPixel"` // = 0.05
+	FfmpegTwoPass         bool    `yaml:"FfmpegTwoPass"`
+
 	YtKey        string `yaml:"YtKey"`
 	YtMaxResults int64  `yaml:"YtMaxResults"` // = 50
 
+	// playlists with at least this many videos are started only after a confirmation, a negative value disables the confirmation.
+	// a job not confirmed in YtListConfirmTimeout is cancelled
+	YtListConfirmSize    int           `yaml:"YtListConfirmSize"`    // = 10
+	YtListConfirmTimeout time.Duration `yaml:"YtListConfirmTimeout"` // = 10 * time.Minute
+
 	YtHttpClientUserAgent string `yaml:"YtHttpClientUserAgent"` // = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.2 Safari/605.1.15"
 
 	// https://golang.org/s/re2syntax
@@ -89,6 +181,12 @@ type TgZeConfig struct {
 	YtListRe string `yaml:"YtListRe"` // = `youtube.com/playlist\?list=([0-9A-Za-z_-]+)`
 
 	YtDownloadLanguages []string `yaml:"YtDownloadLanguages"` // = []string{"english", "german", "russian", "ukrainian"}
+
+	ConfigReloadInterval time.Duration `yaml:"ConfigReloadInterval"`
+	ConfigReloadReport   bool          `yaml:"ConfigReloadReport"`
+
+	YtReRegexp     *regexp.Regexp `yaml:"-"`
+	YtListReRegexp *regexp.Regexp `yaml:"-"`
 }
 
 var (
@@ -96,99 +194,142 @@ var (
 
 	HttpClient = &http.Client{}
 
-	Config TgZeConfig
-
-	YtdlCl         ytdl.Client
-	YtRe, YtListRe *regexp.Regexp
+	ConfigPtr atomic.Pointer[TgZeConfig]
 )
 
-func init() {
+func initBot() {
 	Ctx = context.TODO()
 
+	config := &TgZeConfig{}
 	if v := os.Getenv("YssUrl"); v != "" {
-		Config.YssUrl = v
+		config.ConfigUrl = v
 	}
-	if Config.YssUrl == "" {
-		log("ERROR YssUrl empty")
-		os.Exit(1)
-	}
-	log("YssUrl==%v", Config.YssUrl)
-
-	if err := Config.Get(); err != nil {
-		log("ERROR Config.Get: %v", err)
-		os.Exit(1)
-	}
-
-	if Config.DEBUG {
-		log("DEBUG==true")
+	if v := os.Getenv("ConfigUrl"); v != "" {
+		config.ConfigUrl = v
 	}
-
-	log("Interval==%v", Config.Interval)
-	if Config.Interval == 0 {
-		log("ERROR Interval empty")
+	if config.ConfigUrl == "" {
+		log("ERROR ConfigUrl empty")
 		os.Exit(1)
 	}
+	log("ConfigUrl==%v", config.ConfigUrl)
 
 	var err error
-	YtRe, err = regexp.Compile(Config.YtRe)
+	config.Store, err = NewStore(config.ConfigUrl)
 	if err != nil {
-		log("ERROR Compile YtRe `%s`: %s", Config.YtRe, err)
+		log("ERROR NewStore: %v", err)
 		os.Exit(1)
 	}
-	YtListRe, err = regexp.Compile(Config.YtListRe)
-	if err != nil {
-		log("ERROR Compile YtListRe `%s`: %s", Config.YtListRe, err)
+
+	if err := config.Get(); err != nil {
+		log("ERROR Config.Get: %v", err)
 		os.Exit(1)
 	}
 
-	if Config.TgToken == "" {
-		log("ERROR TgToken empty")
+	if err := config.Check(); err != nil {
+		log("ERROR Config.Check: %v", err)
 		os.Exit(1)
 	}
 
-	log("TgUpdateLog==%+v", Config.TgUpdateLog)
+	ConfigPtr.Store(config)
+	logInit()
 
-	if Config.TgCommandChannels == "" {
-		log("ERROR TgCommandChannels empty")
-		os.Exit(1)
+	// the probes get answers during the rest of the init, readyz fails until it is finished
+	Heartbeat.Store(time.Now().UnixNano())
+	go httpServe()
+
+	if Config().DEBUG {
+		log("DEBUG==true")
+	}
+
+	log("Interval==%v", Config().Interval)
+
+	State.StateUrl = Config().ConfigUrl + ".state"
+	if v := os.Getenv("StateUrl"); v != "" {
+		State.StateUrl = v
 	}
+	log("StateUrl==%v", State.StateUrl)
 
-	if Config.TgCommandChannelsPromoteAdmin == "" {
-		log("ERROR TgCommandChannelsPromoteAdmin empty")
+	State.Store, err = NewStore(State.StateUrl)
+	if err != nil {
+		log("ERROR NewStore: %v", err)
 		os.Exit(1)
 	}
 
-	if Config.YtKey == "" {
-		log("ERROR YtKey empty")
+	if err := stateInit(); err != nil {
+		log("ERROR stateInit: %v", err)
 		os.Exit(1)
 	}
 
-	log("FfmpegPath==`%s`", Config.FfmpegPath)
-	log("FfmpegGlobalOptions==%+v", Config.FfmpegGlobalOptions)
+	log("TgApiUrlBase==%s TgApiLocal==%v", Config().TgApiUrlBase, Config().TgApiLocal)
+	migratefrom := State.TgApiUrlBase
+	if migratefrom == "" {
+		migratefrom = Config().TgApiMigrateFromUrlBase
+	}
+	migratefrom = strings.TrimSuffix(migratefrom, "/")
+	if migratefrom != "" && migratefrom != Config().TgApiUrlBase {
+		if err := tgmigrate(migratefrom); err != nil {
+			log("ERROR tgmigrate: %v", err)
+			os.Exit(1)
+		}
+	}
+	if State.TgApiUrlBase != Config().TgApiUrlBase {
+		if err := stateUpdate(func(state *TgZeState) { state.TgApiUrlBase = Config().TgApiUrlBase }); err != nil {
+			log("ERROR stateUpdate: %v", err)
+			os.Exit(1)
+		}
+	}
+	log("TgMaxFileSizeBytes==%dmb", tgmaxfilesize()>>20)
+
+	log("TgUpdateOffset==%d TgUpdateIds==%v", State.TgUpdateOffset, State.TgUpdateIds)
+
+	log("FfmpegPath==`%s`", Config().FfmpegPath)
+	log("FfmpegGlobalOptions==%+v", Config().FfmpegGlobalOptions)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configCommand(os.Args[2:]))
+	}
+
+	initBot()
+
+	go configReloader()
+
 	sigterm := make(chan os.Signal, 1)
 	signal.Notify(sigterm, syscall.SIGTERM)
 	go func(sigterm chan os.Signal) {
 		<-sigterm
-		tgsendMessage(fmt.Sprintf("%s: sigterm", os.Args[0]), Config.TgZeChatId, "", 0)
+		tgsendMessage(fmt.Sprintf("%s: sigterm", os.Args[0]), Config().TgZeChatId, "", 0)
 		log("sigterm received")
+		auditFlush()
 		os.Exit(1)
 	}(sigterm)
 
+	if err := workdirInit(); err != nil {
+		log("ERROR workdirInit: %v", err)
+		os.Exit(1)
+	}
+
+	go jobsWorker()
+
+	go digestLoop()
+
+	go reportsLoop()
+
+	go auditFlushLoop()
+
+	Started.Store(true)
+
 	for {
 		t0 := time.Now()
+		Heartbeat.Store(t0.UnixNano())
 
-		YtdlCl = ytdl.Client{HTTPClient: &http.Client{Transport: &UserAgentTransport{http.DefaultTransport, Config.YtHttpClientUserAgent}}}
 		processTgUpdates()
 
-		if dur := time.Now().Sub(t0); dur < Config.Interval {
-			time.Sleep(Config.Interval - dur)
+		if dur := time.Now().Sub(t0); dur < Config().Interval {
+			time.Sleep(Config().Interval - dur)
 		}
 	}
-
-	return
 }
 
 func beats(td time.Duration) int {
@@ -203,11 +344,6 @@ func ts() string {
 	)
 }
 
-func log(msg string, args ...interface{}) {
-	s := fmt.Sprintf("%s %s", ts(), msg) + NL
-	fmt.Fprintf(os.Stderr, s, args...)
-}
-
 type TgChatMessageId struct {
 	ChatId    int64
 	MessageId int64
@@ -296,7 +432,11 @@ type YtPlaylistItemSnippet struct {
 }
 
 type YtPlaylistItem struct {
-	Snippet YtPlaylistItemSnippet `json:"snippet"`
+	Snippet        YtPlaylistItemSnippet `json:"snippet"`
+	ContentDetails struct {
+		// VideoPublishedAt is when the video was published, the snippet has when it was added to the playlist
+		VideoPublishedAt string `json:"videoPublishedAt"`
+	} `json:"contentDetails"`
 }
 
 type YtPlaylistItems struct {
@@ -355,12 +495,21 @@ type TgVideo struct {
 	Thumb        TgPhotoSize `json:"thumb"`
 }
 
+type TgDocument struct {
+	FileId       string `json:"file_id"`
+	FileUniqueId string `json:"file_unique_id"`
+	FileName     string `json:"file_name"`
+	MimeType     string `json:"mime_type"`
+	FileSize     int64  `json:"file_size"`
+}
+
 type TgMessage struct {
 	MessageId int64  `json:"message_id"`
 	From      TgUser `json:"from"`
 	Chat      TgChat `json:"chat"`
 	Text      string
 	Audio     TgAudio       `json:"audio"`
+	Document  TgDocument    `json:"document"`
 	Photo     []TgPhotoSize `json:"photo"`
 	Video     TgVideo       `json:"video"`
 }
@@ -399,6 +548,22 @@ type TgChatMemberUpdated struct {
 	ViaChatFolderInviteLink bool         `json:"via_chat_folder_invite_link"`
 }
 
+type TgCallbackQuery struct {
+	Id      string    `json:"id"`
+	From    TgUser    `json:"from"`
+	Message TgMessage `json:"message"`
+	Data    string    `json:"data"`
+}
+
+type TgInlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+type TgInlineKeyboardMarkup struct {
+	InlineKeyboard [][]TgInlineKeyboardButton `json:"inline_keyboard"`
+}
+
 type TgUpdate struct {
 	UpdateId            int64               `json:"update_id"`
 	Message             TgMessage           `json:"message"`
@@ -406,6 +571,7 @@ type TgUpdate struct {
 	ChannelPost         TgMessage           `json:"channel_post"`
 	EditedChannelPost   TgMessage           `json:"edited_channel_post"`
 	MyChatMemberUpdated TgChatMemberUpdated `json:"my_chat_member"`
+	CallbackQuery       TgCallbackQuery     `json:"callback_query"`
 }
 
 type TgGetChatResponse struct {
@@ -431,12 +597,33 @@ type TgGetChatAdministratorsResponse struct {
 
 type YtVideo struct {
 	Id            string
+	PublishedAt   string
+	Duration      time.Duration
 	PlaylistId    string
 	PlaylistIndex int64
 	PlaylistSize  int64
 	PlaylistTitle string
 }
 
+type YtVideoListResponse struct {
+	Items []struct {
+		Id             string `json:"id"`
+		ContentDetails struct {
+			Duration string `json:"duration"`
+		} `json:"contentDetails"`
+	} `json:"items"`
+}
+
+type YtListOptions struct {
+	ItemsFrom int64
+	ItemsTo   int64
+	Reverse   bool
+	Shuffle   bool
+	Latest    int
+	Since     string
+	New       bool
+}
+
 type UserAgentTransport struct {
 	Transport http.RoundTripper
 	UserAgent string
@@ -448,13 +635,18 @@ func (uat *UserAgentTransport) RoundTrip(req *http.Request) (*http.Response, err
 }
 
 func getJson(url string, target interface{}, respjson *string) (err error) {
+	t0 := time.Now()
+	var status int
+	var respBody []byte
+	defer func() { metricsApiResponse(url, t0, status, respBody, err) }()
+
 	resp, err := HttpClient.Get(url)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	status = resp.StatusCode
 
-	var respBody []byte
 	respBody, err = io.ReadAll(resp.Body)
 	if err != nil {
 		return fmt.Errorf("io.ReadAll: %w", err)
@@ -465,7 +657,7 @@ func getJson(url string, target interface{}, respjson *string) (err error) {
 		return fmt.Errorf("json.Decoder.Decode: %w", err)
 	}
 
-	if Config.DEBUG {
+	if Config().DEBUG {
 		log("DEBUG getJson %s response ContentLength:%d Body:"+NL+"%s", url, resp.ContentLength, respBody)
 	}
 	if respjson != nil {
@@ -475,7 +667,12 @@ func getJson(url string, target interface{}, respjson *string) (err error) {
 	return nil
 }
 
-func postJson(url string, data *bytes.Buffer, target interface{}) error {
+func postJson(url string, data *bytes.Buffer, target interface{}) (err error) {
+	t0 := time.Now()
+	var status int
+	var respBody []byte
+	defer func() { metricsApiResponse(url, t0, status, respBody, err) }()
+
 	resp, err := HttpClient.Post(
 		url,
 		"application/json",
@@ -485,8 +682,8 @@ func postJson(url string, data *bytes.Buffer, target interface{}) error {
 		return err
 	}
 	defer resp.Body.Close()
+	status = resp.StatusCode
 
-	var respBody []byte
 	respBody, err = io.ReadAll(resp.Body)
 	if err != nil {
 		return fmt.Errorf("io.ReadAll: %w", err)
@@ -524,12 +721,49 @@ func tgescape(text string) string {
 	).Replace(text)
 }
 
-func tggetUpdates() (uu []TgUpdate, tgrespjson string, err error) {
-	var offset int64
-	if len(Config.TgUpdateLog) > 0 {
-		offset = Config.TgUpdateLog[len(Config.TgUpdateLog)-1] + 1
+func tgmaxfilesize() int64 {
+	config := Config()
+	if config.TgApiLocal && config.TgApiLocalMaxFileSizeBytes > 0 {
+		return config.TgApiLocalMaxFileSizeBytes
+	}
+	return config.TgMaxFileSizeBytes
+}
+
+func tgcallMethod(urlbase, method string) error {
+	var tgresp TgResponseShort
+	err := postJson(
+		fmt.Sprintf("%s/bot%s/%s", urlbase, Config().TgToken, method),
+		bytes.NewBuffer([]byte("{}")),
+		&tgresp,
+	)
+	if err != nil {
+		return fmt.Errorf("postJson: %w", err)
+	}
+
+	if !tgresp.Ok {
+		return fmt.Errorf("%s: %s", method, tgresp.Description)
+	}
+
+	return nil
+}
+
+func tgmigrate(from string) error {
+	// https://core.telegram.org/bots/api#logout
+	// https://core.telegram.org/bots/api#close
+	method := "close"
+	if from == TgApiCloudUrlBase {
+		method = "logOut"
 	}
-	getUpdatesUrl := fmt.Sprintf("%s/bot%s/getUpdates?offset=%d", Config.TgApiUrlBase, Config.TgToken, offset)
+
+	log("migrating from %s to %s: %s", from, Config().TgApiUrlBase, method)
+	return tgcallMethod(from, method)
+}
+
+func tggetUpdates() (uu []TgUpdate, tgrespjson string, err error) {
+	StateMutex.Lock()
+	offset := State.TgUpdateOffset
+	StateMutex.Unlock()
+	getUpdatesUrl := fmt.Sprintf("%s/bot%s/getUpdates?offset=%d", Config().TgApiUrlBase, Config().TgToken, offset)
 
 	var tgResp TgGetUpdatesResponse
 	err = getJson(getUpdatesUrl, &tgResp, &tgrespjson)
@@ -544,7 +778,7 @@ func tggetUpdates() (uu []TgUpdate, tgrespjson string, err error) {
 }
 
 func tggetChat(chatid int64) (chat TgChat, err error) {
-	getChatUrl := fmt.Sprintf("%s/bot%s/getChat?chat_id=%d", Config.TgApiUrlBase, Config.TgToken, chatid)
+	getChatUrl := fmt.Sprintf("%s/bot%s/getChat?chat_id=%d", Config().TgApiUrlBase, Config().TgToken, chatid)
 	var tgResp TgGetChatResponse
 
 	tries := []int{1, 2, 3}
@@ -589,7 +823,7 @@ func tgpromoteChatMember(chatid, userid int64) (bool, error) {
 
 	var tgresp TgPromoteChatMemberResponse
 	err = postJson(
-		fmt.Sprintf("%s/bot%s/promoteChatMember", Config.TgApiUrlBase, Config.TgToken),
+		fmt.Sprintf("%s/bot%s/promoteChatMember", Config().TgApiUrlBase, Config().TgToken),
 		bytes.NewBuffer(promoteChatMemberJSON),
 		&tgresp,
 	)
@@ -604,8 +838,13 @@ func tgpromoteChatMember(chatid, userid int64) (bool, error) {
 	return tgresp.Result, nil
 }
 
+// tggetChatAdministrators returns the admins cached for TgChatAdminsCacheTtl
 func tggetChatAdministrators(chatid int64) (mm []TgChatMember, err error) {
-	getChatAdministratorsUrl := fmt.Sprintf("%s/bot%s/getChatAdministrators?chat_id=%d", Config.TgApiUrlBase, Config.TgToken, chatid)
+	if mm, ok := chatAdminsCached(chatid); ok {
+		return mm, nil
+	}
+
+	getChatAdministratorsUrl := fmt.Sprintf("%s/bot%s/getChatAdministrators?chat_id=%d", Config().TgApiUrlBase, Config().TgToken, chatid)
 	var tgResp TgGetChatAdministratorsResponse
 
 	err = getJson(getChatAdministratorsUrl, &tgResp, nil)
@@ -616,6 +855,8 @@ func tggetChatAdministrators(chatid int64) (mm []TgChatMember, err error) {
 		return nil, fmt.Errorf("Tg response not ok: %s", tgResp.Description)
 	}
 
+	chatAdminsCache(chatid, tgResp.Result)
+
 	return tgResp.Result, nil
 }
 
@@ -634,49 +875,49 @@ func processTgUpdates() {
 	uu, respjson, err = tggetUpdates()
 	if err != nil {
 		log("tggetUpdates: %v", err)
-		os.Exit(1)
+		tggetUpdatesFailed(err)
+		return
 	}
+	TgGetUpdatesFailures = 0
 
-	var m, prevm TgMessage
-	for _, u := range uu {
-
-		log("# UpdateId:%d ", u.UpdateId)
+	defer func(uu []TgUpdate) {
+		if err := stateConfirmUpdates(uu); err != nil {
+			log("ERROR stateConfirmUpdates: %s", err)
+		}
+	}(uu)
 
-		/*
-			if len(TgUpdateLog) > 0 && u.UpdateId < TgUpdateLog[len(TgUpdateLog)-1] {
-				log("WARNING this telegram update id:%d is older than last id:%d, skipping", u.UpdateId, TgUpdateLog[len(TgUpdateLog)-1])
-				continue
-			}
-		*/
+	var m, prevm TgMessage
+	for _, u := range stateNewUpdates(uu) {
+		uctx := logWith(Ctx, "update_id", u.UpdateId)
 
-		if slices.Contains(Config.TgUpdateLog, u.UpdateId) {
-			log("WARNING this telegram update id:%d was already processed, skipping", u.UpdateId)
-			continue
-		}
+		logctx(uctx, "# UpdateId:%d ", u.UpdateId)
 
-		Config.TgUpdateLog = append(Config.TgUpdateLog, u.UpdateId)
-		if len(Config.TgUpdateLog) > Config.TgUpdateLogMaxSize {
-			Config.TgUpdateLog = Config.TgUpdateLog[len(Config.TgUpdateLog)-Config.TgUpdateLogMaxSize:]
-		}
-		if err := Config.Put(); err != nil {
-			log("ERROR Config.Put: %s", err)
-		}
+		stateHandled(u.UpdateId)
 
 		var iseditmessage bool
 		var ischannelpost bool
 		if u.Message.MessageId != 0 {
+			MetricUpdates.Inc("message")
 			m = u.Message
 		} else if u.EditedMessage.MessageId != 0 {
+			MetricUpdates.Inc("edited_message")
 			m = u.EditedMessage
 			iseditmessage = true
 		} else if u.ChannelPost.MessageId != 0 {
+			MetricUpdates.Inc("channel_post")
 			m = u.ChannelPost
 			ischannelpost = true
 		} else if u.EditedChannelPost.MessageId != 0 {
+			MetricUpdates.Inc("edited_channel_post")
 			m = u.EditedChannelPost
 			ischannelpost = true
 			iseditmessage = true
+		} else if u.CallbackQuery.Id != "" {
+			MetricUpdates.Inc("callback_query")
+			processTgCallbackQuery(u.CallbackQuery)
+			continue
 		} else if u.MyChatMemberUpdated.Date != 0 {
+			MetricUpdates.Inc("my_chat_member")
 			cmu := u.MyChatMemberUpdated
 			report := fmt.Sprintf(
 				"*MyChatMemberUpdated*"+NL+
@@ -702,82 +943,87 @@ func processTgUpdates() {
 				cmu.OldChatMember.User.Username, cmu.OldChatMember.User.Id, cmu.OldChatMember.Status,
 				cmu.NewChatMember.User.Username, cmu.NewChatMember.User.Id, cmu.NewChatMember.Status,
 			)
-			_, err = tgsendMessage(report, Config.TgZeChatId, "MarkdownV2", 0)
-			if err != nil {
-				log("tgsendMessage: %v", err)
-			}
+			tgreport(report)
 		} else {
-			log("WARNING unsupported type of update id:%d received:"+NL+"%s", u.UpdateId, respjson)
-			_, err = tgsendMessage(fmt.Sprintf("unsupported type of update (id:%d) received:"+NL+"```"+NL+"%s"+NL+"```", u.UpdateId, respjson), Config.TgZeChatId, "MarkdownV2", 0)
+			MetricUpdates.Inc("unsupported")
+			logctx(uctx, "WARNING unsupported type of update id:%d received:"+NL+"%s", u.UpdateId, respjson)
+			_, err = tgsendMessage(fmt.Sprintf("unsupported type of update (id:%d) received:"+NL+"```"+NL+"%s"+NL+"```", u.UpdateId, respjson), Config().TgZeChatId, "MarkdownV2", 0)
 			if err != nil {
-				log("WARNING tgsendMessage: %v", err)
+				logctx(uctx, "WARNING tgsendMessage: %v", err)
 				continue
 			}
 			continue
 		}
 
+		uctx = logWith(uctx, "chat_id", m.Chat.Id, "user_id", m.From.Id)
+
 		if m.Chat.Type == "channel" {
 			ischannelpost = true
 		}
 
 		if ischannelpost {
-			add := true
-			for _, i := range Config.TgAllChannelsChatIds {
-				if m.Chat.Id == i {
-					add = false
-				}
-			}
+			StateMutex.Lock()
+			add := !slices.Contains(State.TgAllChannelsChatIds, m.Chat.Id)
+			StateMutex.Unlock()
 			if add {
-				Config.TgAllChannelsChatIds = append(Config.TgAllChannelsChatIds, m.Chat.Id)
-				sort.Slice(Config.TgAllChannelsChatIds, func(i, j int) bool { return Config.TgAllChannelsChatIds[i] < Config.TgAllChannelsChatIds[j] })
-				if err := Config.Put(); err != nil {
-					log("ERROR Config.Put: %s", err)
+				err := stateUpdate(func(state *TgZeState) {
+					if slices.Contains(state.TgAllChannelsChatIds, m.Chat.Id) {
+						return
+					}
+					state.TgAllChannelsChatIds = append(state.TgAllChannelsChatIds, m.Chat.Id)
+					sort.Slice(state.TgAllChannelsChatIds, func(i, j int) bool { return state.TgAllChannelsChatIds[i] < state.TgAllChannelsChatIds[j] })
+				})
+				if err != nil {
+					logctx(uctx, "ERROR stateUpdate: %s", err)
 				}
 			}
 		}
 
-		log("telegram message from:`%s` chat:`%s` text:`%s`", m.From.Username, m.Chat.Username, m.Text)
+		logctx(uctx, "telegram message from:`%s` chat:`%s` text:`%s`", m.From.Username, m.Chat.Username, m.Text)
 		if m.Text == "" {
 			continue
 		}
 
-		shouldreport := true
-		if m.From.Id == Config.TgZeChatId {
+		var newuser, shouldreport bool
+		if !Config().TgReportMessagesDisabled {
+			newuser = reportNewUser(m.From.Id)
+			shouldreport = reportMessage(m, newuser)
+		}
+		if m.From.Id == Config().TgZeChatId {
 			shouldreport = false
 		}
 		var chatadmins string
-		if aa, err := tggetChatAdministrators(m.Chat.Id); err == nil {
-			for _, a := range aa {
-				chatadmins += fmt.Sprintf("username:@%s id:%d status:%s  ", a.User.Username, a.User.Id, a.Status)
-				if a.User.Id == Config.TgZeChatId {
-					shouldreport = false
+		// private chats have no admins and telegram answers an error every time
+		if shouldreport && m.Chat.Type != "private" {
+			if aa, err := tggetChatAdministrators(m.Chat.Id); err == nil {
+				for _, a := range aa {
+					chatadmins += fmt.Sprintf("username:@%s id:%d status:%s  ", a.User.Username, a.User.Id, a.Status)
+					if a.User.Id == Config().TgZeChatId {
+						shouldreport = false
+					}
 				}
+			} else {
+				logctx(uctx, "tggetChatAdministrators: %v", err)
 			}
-		} else {
-			log("tggetChatAdministrators: %v", err)
 		}
 		if shouldreport && m.MessageId != 0 {
 			report := fmt.Sprintf(
 				"*Message*"+NL+
-					"from: username:@%s id:`%d`"+NL+
-					"chat: username:@%s id:%d type:%s title:%s"+NL+
+					"from: username:@%s id:`%d` newuser:%v"+NL+
+					"chat: id:`%d` username:@%s type:%s title:%s"+NL+
 					"chat admins: %s"+NL+
 					"iseditmessage:%v"+NL+
 					"text:"+NL+
 					"```"+NL+
 					"%s"+NL+
 					"```",
-				m.From.Username, m.From.Id,
+				m.From.Username, m.From.Id, newuser,
 				m.Chat.Id, m.Chat.Username, m.Chat.Type, tgescape(m.Chat.Title),
 				chatadmins,
 				iseditmessage,
 				m.Text,
 			)
-			_, err = tgsendMessage(report, Config.TgZeChatId, "MarkdownV2", 0)
-			if err != nil {
-				log("tgsendMessage: %v", err)
-				continue
-			}
+			tgreport(report)
 		}
 
 		if strings.TrimSpace(m.Text) == "/id" {
@@ -786,14 +1032,38 @@ func processTgUpdates() {
 				m.Chat.Id, "MarkdownV2", m.MessageId,
 			)
 			if err != nil {
-				log("tgsendMessage: %v", err)
+				logctx(uctx, "tgsendMessage: %v", err)
+			}
+		}
+
+		if processTgAccessCommand(m) || processTgRoleCommand(m) || processTgAuditCommand(m) || processTgStatsCommand(m) {
+			continue
+		}
+
+		if strings.TrimSpace(m.Text) == "/quota" {
+			_, err = tgsendMessage(quotaStatus(m.From.Id, m.Chat.Id), m.Chat.Id, "", m.MessageId)
+			if err != nil {
+				logctx(uctx, "tgsendMessage: %v", err)
+			}
+		}
+
+		if strings.TrimSpace(m.Text) == "/cancel" {
+			n := jobsCancel(m.Chat.Id, m.From.Id)
+			_, err = tgsendMessage(fmt.Sprintf("cancelling %d jobs", n), m.Chat.Id, "", m.MessageId)
+			if err != nil {
+				logctx(uctx, "tgsendMessage: %v", err)
 			}
 		}
 
-		if strings.TrimSpace(m.Text) == Config.TgCommandChannels {
+		if strings.TrimSpace(m.Text) == Config().TgCommandChannels && !roleAllowed(m.From.Id, RoleAdmin) {
+			roleDenied(m, "TgCommandChannels", RoleAdmin)
+		} else if strings.TrimSpace(m.Text) == Config().TgCommandChannels {
+			StateMutex.Lock()
+			channels := slices.Clone(State.TgAllChannelsChatIds)
+			StateMutex.Unlock()
 			var totalchannels, removedchannels int
-			totalchannels = len(Config.TgAllChannelsChatIds)
-			for _, i := range Config.TgAllChannelsChatIds {
+			totalchannels = len(channels)
+			for _, i := range channels {
 				var err error
 				c, getChatErr := tggetChat(i)
 				if getChatErr != nil {
@@ -804,7 +1074,7 @@ func processTgUpdates() {
 					}
 					_, err = tgsendMessage(fmt.Sprintf("id:%d err:%v", i, getChatErr), m.Chat.Id, "", 0)
 					if err != nil {
-						log("tgsendMessage: %v", err)
+						logctx(uctx, "tgsendMessage: %v", err)
 					}
 					continue
 				}
@@ -816,53 +1086,60 @@ func processTgUpdates() {
 				}
 				_, err = tgsendMessage(chatinfo, m.Chat.Id, "", 0)
 				if err != nil {
-					log("tgsendMessage: %v", err)
+					logctx(uctx, "tgsendMessage: %v", err)
 				}
 			}
+			audit(m, "TgCommandChannels", "ok", fmt.Sprintf("channels:%d removed:%d", totalchannels, removedchannels))
 			totalmessage := fmt.Sprintf("Total %d channels.", totalchannels)
 			if removedchannels > 0 {
 				totalmessage += NL + fmt.Sprintf("Removed %d channels.", removedchannels)
 			}
 			_, err = tgsendMessage(totalmessage, m.Chat.Id, "", m.MessageId)
 			if err != nil {
-				log("tgsendMessage: %v", err)
+				logctx(uctx, "tgsendMessage: %v", err)
 			}
 		}
 
-		if strings.TrimSpace(m.Text) == Config.TgCommandChannelsPromoteAdmin {
+		if strings.TrimSpace(m.Text) == Config().TgCommandChannelsPromoteAdmin && !roleAllowed(m.From.Id, RoleOwner) {
+			roleDenied(m, "TgCommandChannelsPromoteAdmin", RoleOwner)
+		} else if strings.TrimSpace(m.Text) == Config().TgCommandChannelsPromoteAdmin {
+			StateMutex.Lock()
+			channels := slices.Clone(State.TgAllChannelsChatIds)
+			StateMutex.Unlock()
 			var total, totalok int
-			for _, i := range Config.TgAllChannelsChatIds {
+			for _, i := range channels {
 				success, err := tgpromoteChatMember(i, m.From.Id)
 				total++
 				if success != true || err != nil {
-					log("tgpromoteChatMember %d %d: %v", i, m.From.Id, err)
+					logctx(uctx, "tgpromoteChatMember %d %d: %v", i, m.From.Id, err)
 				} else {
 					totalok++
-					log("tgpromoteChatMember %d %d: ok", i, m.From.Id)
+					logctx(uctx, "tgpromoteChatMember %d %d: ok", i, m.From.Id)
 				}
 			}
+			audit(m, "TgCommandChannelsPromoteAdmin", "ok", fmt.Sprintf("promoted user:%d in %d of %d channels", m.From.Id, totalok, total))
 			_, err = tgsendMessage(fmt.Sprintf("ok for %d of total %d channels.", totalok, total), m.Chat.Id, "", m.MessageId)
 			if err != nil {
-				log("tgsendMessage: %v", err)
+				logctx(uctx, "tgsendMessage: %v", err)
 			}
 		}
 
-		if strings.TrimSpace(m.Text) == Config.TgQuest1 {
-			_, err = tgsendMessage(Config.TgQuest1Key, m.Chat.Id, "", 0)
+		if strings.TrimSpace(m.Text) == Config().TgQuest1 {
+			_, err = tgsendMessage(Config().TgQuest1Key, m.Chat.Id, "", 0)
 			if err != nil {
-				log("tgsendMessage: %v", err)
+				logctx(uctx, "tgsendMessage: %v", err)
 			}
 		}
-		if strings.TrimSpace(m.Text) == Config.TgQuest2 {
-			_, err = tgsendMessage(Config.TgQuest2Key, m.Chat.Id, "", 0)
+		if strings.TrimSpace(m.Text) == Config().TgQuest2 {
+			_, err = tgsendMessage(Config().TgQuest2Key, m.Chat.Id, "", 0)
 			if err != nil {
-				log("tgsendMessage: %v", err)
+				logctx(uctx, "tgsendMessage: %v", err)
 			}
 		}
-		if strings.TrimSpace(m.Text) == Config.TgQuest3 {
-			_, err = tgsendMessage(Config.TgQuest3Key, m.Chat.Id, "", 0)
+		if strings.TrimSpace(m.Text) == Config().TgQuest3 {
+			_, err = tgsendMessage(Config().TgQuest3Key, m.Chat.Id, "", 0)
 			if err != nil {
-				log("tgsendMessage: %v", err)
+				logctx(uctx, "tgsendMessage: %v", err)
 			}
 		}
 
@@ -872,81 +1149,100 @@ func processTgUpdates() {
 		}
 		prevm = m
 
+		var downloadraw bool
+		if slices.Contains(strings.Fields(strings.ToLower(m.Text)), "raw") {
+			downloadraw = true
+		}
+
+		if (Config().YtListReRegexp.MatchString(m.Text) || Config().YtReRegexp.MatchString(m.Text)) && !accessAllowed(m.From.Id, m.Chat.Id) {
+			accessDenied(m)
+			continue
+		}
+
 		var videos []YtVideo
 
-		if mm := YtListRe.FindStringSubmatch(m.Text); len(mm) > 1 {
+		var confirm bool
+
+		if mm := Config().YtListReRegexp.FindStringSubmatch(m.Text); len(mm) > 1 {
+			listoptions, err := ytlistoptions(m.Text)
+			if err != nil {
+				logctx(uctx, "ytlistoptions: %v", err)
+				_, err = tgsendMessage(fmt.Sprintf("ERROR %v", err), m.Chat.Id, "", m.MessageId)
+				if err != nil {
+					logctx(uctx, "tgsendMessage: %v", err)
+				}
+				continue
+			}
 			videos, err = getList(mm[1])
 			if err != nil {
-				log("getList: %v", err)
+				logctx(uctx, "getList: %v", err)
+				reportFailure(m, fmt.Errorf("getList: %w", err))
+				continue
+			}
+			listsize := len(videos)
+			videos = ytlistfilter(videos, listoptions, m.Chat.Id)
+			logctx(uctx, "playlist videos:%d of %d options:%+v", len(videos), listsize, listoptions)
+			if len(videos) == 0 {
+				_, err = tgsendMessage(fmt.Sprintf("no videos selected of %d in the playlist", listsize), m.Chat.Id, "", m.MessageId)
+				if err != nil {
+					logctx(uctx, "tgsendMessage: %v", err)
+				}
 				continue
 			}
-		} else if mm := YtRe.FindStringSubmatch(m.Text); len(mm) > 1 {
+			if Config().YtListConfirmSize > 0 && len(videos) >= Config().YtListConfirmSize {
+				confirm = true
+			}
+		} else if mm := Config().YtReRegexp.FindStringSubmatch(m.Text); len(mm) > 1 {
 			videos = []YtVideo{YtVideo{Id: mm[1]}}
 		}
 
 		if len(videos) > 0 {
-
-			var postingerr error
-			var vinfo *ytdl.Video
-			for _, v := range videos {
-				vinfo, err = YtdlCl.GetVideoContext(Ctx, v.Id)
+			if err := quotaTake(uctx, m.From.Id, m.Chat.Id, len(videos)); err != nil {
+				logctx(uctx, "quota from:`%s` id:%d chat:%d: %v", m.From.Username, m.From.Id, m.Chat.Id, err)
+				audit(m, "download", "quota", err.Error())
+				reportFailure(m, err)
+				_, err = tgsendMessage(fmt.Sprintf("sorry, %v", err), m.Chat.Id, "", m.MessageId)
 				if err != nil {
-					log("ERROR GetVideoContext: %v", err)
-					postingerr = err
-					break
-				}
-
-				if downloadvideo {
-					err = postVideo(v, vinfo, m)
-					if err != nil {
-						log("ERROR postVideo: %v", err)
-						postingerr = err
-						break
-					}
-				} else {
-					err = postAudio(v, vinfo, m)
-					if err != nil {
-						log("ERROR postAudio: %v", err)
-						postingerr = err
-						break
-					}
-				}
-
-				if len(videos) > 3 {
-					time.Sleep(11 * time.Second)
+					logctx(uctx, "tgsendMessage: %v", err)
 				}
+				continue
 			}
 
-			if postingerr == nil {
-				if ischannelpost {
-					// TODO do not delete if playlist
-					err = tgdeleteMessage(m.Chat.Id, m.MessageId)
-					if err != nil {
-						log("tgdeleteMessage: %v", err)
-					}
-				}
+			job := &Job{
+				UpdateId:    u.UpdateId,
+				Message:     m,
+				ChannelPost: ischannelpost,
+				Videos:      videos,
+				Video:       downloadvideo,
+				Raw:         downloadraw,
+			}
+			if confirm {
+				err = jobsConfirm(job)
 			} else {
-				_, err = tgsendMessage(fmt.Sprintf("ERROR %v", postingerr), m.Chat.Id, "", m.MessageId)
+				err = jobsEnqueue(job)
+			}
+			if err != nil {
+				logctx(uctx, "jobsEnqueue: %v", err)
+				quotaRefund(uctx, m.From.Id, m.Chat.Id)
+				reportFailure(m, err)
+				_, err = tgsendMessage(fmt.Sprintf("ERROR %v", err), m.Chat.Id, "", m.MessageId)
 				if err != nil {
-					log("tgsendMessage: %v", err)
+					logctx(uctx, "tgsendMessage: %v", err)
 				}
 			}
-
 		}
 	}
 
 	return
 }
 
-func postVideo(v YtVideo, vinfo *ytdl.Video, m TgMessage) error {
-	var videoFormat, videoSmallestFormat ytdl.Format
+func postVideo(job *Job, v YtVideo, vinfo *ytdl.Video) error {
+	ctx := logWith(job.Ctx, "video_id", v.Id)
+	config, maxfilesize := Config(), tgmaxfilesize()
+	pipelineupload := ffmpegPipelineUpload()
+	m, progress := job.Message, job.Progress
 
-	var tgdeleteMessages []TgChatMessageId
-	defer func(mm *[]TgChatMessageId) {
-		for _, cm := range *mm {
-			tgdeleteMessage(cm.ChatId, cm.MessageId)
-		}
-	}(&tgdeleteMessages)
+	var videoFormat, videoSmallestFormat ytdl.Format
 
 	for _, f := range vinfo.Formats.WithAudioChannels() {
 		if !strings.Contains(f.MimeType, "/mp4") {
@@ -959,41 +1255,55 @@ func postVideo(v YtVideo, vinfo *ytdl.Video, m TgMessage) error {
 		if !strings.HasPrefix(f.MimeType, "video/mp4") || f.QualityLabel == "" || f.AudioQuality == "" {
 			continue
 		}
-		flang := strings.ToLower(f.LanguageDisplayName())
-		log("format: ContentLength:%dmb Language:%#v", f.ContentLength>>20, flang)
-		if flang != "" {
-			skip := true
-			for _, l := range Config.YtDownloadLanguages {
-				if strings.Contains(flang, l) {
-					skip = false
-				}
-			}
-			if skip {
-				continue
-			}
+		if !ytlanguageok(ctx, f) {
+			continue
 		}
 		if videoSmallestFormat.ItagNo == 0 || f.Bitrate < videoSmallestFormat.Bitrate {
 			videoSmallestFormat = f
 		}
-		if fsize < Config.TgMaxFileSizeBytes && f.Bitrate > videoFormat.Bitrate {
+		if fsize < maxfilesize && f.Bitrate > videoFormat.Bitrate {
 			videoFormat = f
 		}
 	}
 
-	var targetVideoBitrateKbps int64
+	var target FfmpegTarget
 	if videoFormat.ItagNo == 0 {
 		videoFormat = videoSmallestFormat
-		targetVideoSize := int64(Config.TgMaxFileSizeBytes - (Config.TgAudioBitrateKbps*1024*int64(vinfo.Duration.Seconds()+1))/8)
-		targetVideoBitrateKbps = int64(((targetVideoSize * 8) / int64(vinfo.Duration.Seconds()+1)) / 1024)
+		target = ffmpegTargetVideo(maxfilesize, vinfo.Duration, videoFormat)
+	}
+	transcode := config.FfmpegPath != "" && target.VideoBitrateKbps > 0
+	pipeline := transcode && config.FfmpegPipeline && ffmpegPipelineSource(videoFormat)
+	if transcode && config.FfmpegPipeline && !pipeline {
+		logctx(ctx, "format %s cannot be piped into ffmpeg, transcoding from the file", videoFormat.MimeType)
+	}
+	if pipeline && pipelineupload {
+		target = ffmpegTargetVideo(ffmpegPipelineUploadSize(), vinfo.Duration, videoFormat)
+	}
+
+	need := ytformatSize(videoFormat, vinfo.Duration)
+	if transcode {
+		need += maxfilesize
+	}
+	if pipeline {
+		// the original is not written to disk and the output only if it is not uploaded as it is transcoded
+		need = 0
+		if !pipelineupload {
+			need = maxfilesize
+		}
+	}
+	if err := workdirCheck(job.Dir, need); err != nil {
+		return fmt.Errorf("workdirCheck: %w", err)
 	}
 
-	ytstream, ytstreamsize, err := YtdlCl.GetStreamContext(Ctx, vinfo, &videoFormat)
+	ytstream, err := ytstreamOpen(ctx, job.Ytdl, vinfo, &videoFormat)
 	if err != nil {
-		return fmt.Errorf("GetStreamContext: %w", err)
+		return fmt.Errorf("ytstreamOpen: %w", err)
 	}
 	defer ytstream.Close()
+	ytstreamsize := ytstream.Size
 
-	log(
+	logctx(
+		ctx,
 		"downloading youtu.be/%s video size:%dmb quality:%s bitrate:%dkbps duration:%s language:%#v",
 		v.Id,
 		ytstreamsize>>20,
@@ -1017,89 +1327,115 @@ func postVideo(v YtVideo, vinfo *ytdl.Video, m TgMessage) error {
 		)
 	}
 
-	tgvideoFilename := fmt.Sprintf("%s.%s.mp4", ts(), v.Id)
-	tgvideoFile, err := os.OpenFile(tgvideoFilename, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return fmt.Errorf("os.OpenFile: %w", err)
+	job.Format = fmt.Sprintf("%s %s", videoFormat.MimeType, videoFormat.QualityLabel)
+
+	// the caption and the size are of the last transcoding, they are set before the transcoded file is sent
+	transcoded := func(target FfmpegTarget) {
+		tgvideoCaption += NL + fmt.Sprintf("(transcoded to %s)", target)
+		job.Format += " transcoded " + target.String()
+	}
+	sendvideo := func(path string, r io.Reader) (err error) {
+		width, height := ffmpegScaleSize(target, videoFormat)
+		tgvideo, err = tgsendVideoFile(
+			ctx,
+			m.Chat.Id,
+			tgvideoCaption,
+			path,
+			r,
+			progress,
+			width,
+			height,
+			vinfo.Duration,
+		)
+		return err
 	}
 
-	/*
-		if Config.DEBUG {
-			downloadingmessagetext := fmt.Sprintf("%s"+NL+"youtu.be/%s %s %s"+NL+"downloading", vinfo.Title, v.Id, vinfo.Duration, videoFormat.QualityLabel)
-			if v.PlaylistId != "" && v.PlaylistTitle != "" {
-				downloadingmessagetext = fmt.Sprintf("%d/%d %s "+NL, v.PlaylistIndex+1, v.PlaylistSize, v.PlaylistTitle) + downloadingmessagetext
+	if pipeline {
+		filename2 := filepath.Join(job.Dir, v.Id+".transcoded.mp4")
+		defer removeFile(filename2)
+
+		var upload func(io.Reader) error
+		if pipelineupload {
+			transcoded(target)
+			upload = func(r io.Reader) error { return sendvideo("", r) }
+		}
+
+		progress.Header(fmt.Sprintf("%s"+NL+"youtu.be/%s %s %s", vinfo.Title, v.Id, vinfo.Duration, videoFormat.QualityLabel))
+		progress.Stage(fmt.Sprintf("downloading and transcoding to %s", target), int64(vinfo.Duration.Seconds()), "%")
+
+		t0 := time.Now()
+		written, err := FfmpegPipeline(ctx, ytstream, filename2, target, progress, upload)
+		job.Bytes += written
+		if err != nil {
+			return fmt.Errorf("FfmpegPipeline: %w", err)
+		}
+		MetricDownloadDuration.ObserveSince(t0, "video")
+		logctx(ctx, "downloaded and transcoded youtu.be/%s video in %v", v.Id, time.Since(t0).Truncate(time.Second))
+
+		if upload == nil {
+			// the original is not kept so an output over the limit is encoded again from itself
+			target, err = ffmpegFitSize(ctx, "", filename2, target, videoFormat, vinfo.Duration, progress)
+			if err != nil {
+				return fmt.Errorf("ffmpegFitSize: %w", err)
 			}
-			if downloadingmessage, err := tgsendMessage(downloadingmessagetext, m.Chat.Id, "", 0); err == nil && downloadingmessage != nil {
-				tgdeleteMessages = append(tgdeleteMessages, TgChatMessageId{m.Chat.Id, downloadingmessage.MessageId})
+			transcoded(target)
+			if err := sendvideo(filename2, nil); err != nil {
+				return fmt.Errorf("tgsendVideoFile: %w", err)
 			}
 		}
-	*/
+		return nil
+	}
+
+	tgvideoFilename := filepath.Join(job.Dir, v.Id+".mp4")
+	tgvideoFile, err := os.OpenFile(tgvideoFilename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile: %w", err)
+	}
+	defer removeFile(tgvideoFilename)
+
+	progress.Header(fmt.Sprintf("%s"+NL+"youtu.be/%s %s %s", vinfo.Title, v.Id, vinfo.Duration, videoFormat.QualityLabel))
+	progress.Stage("downloading", ytstreamsize, "mb")
 
 	t0 := time.Now()
-	_, err = io.Copy(tgvideoFile, ytstream)
+	written, err := io.Copy(tgvideoFile, &ProgressReader{Reader: ytstream, Progress: progress})
+	job.Bytes += written
 	if err != nil {
+		tgvideoFile.Close()
 		return fmt.Errorf("download youtu.be/%s video: %w", v.Id, err)
 	}
 
 	if err := ytstream.Close(); err != nil {
-		log("ytstream.Close: %v", err)
+		logctx(ctx, "ytstream.Close: %v", err)
 	}
 	if err := tgvideoFile.Close(); err != nil {
 		return fmt.Errorf("os.File.Close: %w", err)
 	}
 
-	log("downloaded youtu.be/%s video in %v", v.Id, time.Since(t0).Truncate(time.Second))
-	/*
-		if Config.DEBUG {
-			downloadedmessagetext := fmt.Sprintf("%s"+NL+"youtu.be/%s %s %s"+NL+"downloaded video in %v", vinfo.Title, v.Id, vinfo.Duration, videoFormat.QualityLabel, time.Since(t0).Truncate(time.Second))
-			if targetVideoBitrateKbps > 0 {
-				downloadedmessagetext += NL + fmt.Sprintf("transcoding to audio:%dkbps video:%dkbps", Config.TgAudioBitrateKbps, targetVideoBitrateKbps)
-			}
-			downloadedmessage, err := tgsendMessage(downloadedmessagetext, m.Chat.Id, "", 0)
-			if err == nil && downloadedmessage != nil {
-				tgdeleteMessages = append(tgdeleteMessages, TgChatMessageId{m.Chat.Id, downloadedmessage.MessageId})
-			}
-		}
-	*/
+	MetricDownloadDuration.ObserveSince(t0, "video")
+	logctx(ctx, "downloaded youtu.be/%s video in %v", v.Id, time.Since(t0).Truncate(time.Second))
 
-	if Config.FfmpegPath != "" && targetVideoBitrateKbps > 0 {
-		filename2 := fmt.Sprintf("%s.%s.v%dk.a%dk.mp4", ts(), v.Id, targetVideoBitrateKbps, Config.TgAudioBitrateKbps)
-		err := FfmpegTranscode(tgvideoFilename, filename2, targetVideoBitrateKbps, Config.TgAudioBitrateKbps)
+	if transcode {
+		filename2 := filepath.Join(job.Dir, v.Id+".transcoded.mp4")
+		defer removeFile(filename2)
+		progress.Stage(fmt.Sprintf("transcoding to %s", target), int64(vinfo.Duration.Seconds()), "%")
+		err := FfmpegTranscode(ctx, tgvideoFilename, filename2, nil, nil, target, progress)
 		if err != nil {
 			return fmt.Errorf("FfmpegTranscode `%s`: %w", tgvideoFilename, err)
 		}
-		tgvideoCaption += NL + fmt.Sprintf("(transcoded to video:%dkbps audio:%dkbps)", targetVideoBitrateKbps, Config.TgAudioBitrateKbps)
-		if err := os.Remove(tgvideoFilename); err != nil {
-			log("os.Remove `%s`: %v", tgvideoFilename, err)
+		target, err = ffmpegFitSize(ctx, tgvideoFilename, filename2, target, videoFormat, vinfo.Duration, progress)
+		if err != nil {
+			return fmt.Errorf("ffmpegFitSize: %w", err)
 		}
+		transcoded(target)
+		removeFile(tgvideoFilename)
 		tgvideoFilename = filename2
 	}
 
-	tgvideoReader, err := os.Open(tgvideoFilename)
-	if err != nil {
-		return fmt.Errorf("os.Open: %w", err)
-	}
-	defer tgvideoReader.Close()
-
-	tgvideo, err = tgsendVideoFile(
-		m.Chat.Id,
-		tgvideoCaption,
-		tgvideoReader,
-		videoFormat.Width,
-		videoFormat.Height,
-		vinfo.Duration,
-	)
+	err = sendvideo(tgvideoFilename, nil)
 	if err != nil {
 		return fmt.Errorf("tgsendVideoFile: %w", err)
 	}
 
-	if err := tgvideoReader.Close(); err != nil {
-		log("os.File.Close: %v", err)
-	}
-	if err := os.Remove(tgvideoFilename); err != nil {
-		log("os.Remove: %v", err)
-	}
-
 	if tgvideo.FileId == "" {
 		return fmt.Errorf("tgsendVideoFile: file_id empty")
 	}
@@ -1107,15 +1443,13 @@ func postVideo(v YtVideo, vinfo *ytdl.Video, m TgMessage) error {
 	return nil
 }
 
-func postAudio(v YtVideo, vinfo *ytdl.Video, m TgMessage) error {
-	var audioFormat, audioSmallestFormat ytdl.Format
+func postAudio(job *Job, v YtVideo, vinfo *ytdl.Video) error {
+	ctx := logWith(job.Ctx, "video_id", v.Id)
+	config, maxfilesize := Config(), tgmaxfilesize()
+	pipelineupload := ffmpegPipelineUpload()
+	m, progress := job.Message, job.Progress
 
-	var tgdeleteMessages []TgChatMessageId
-	defer func(mm *[]TgChatMessageId) {
-		for _, cm := range *mm {
-			tgdeleteMessage(cm.ChatId, cm.MessageId)
-		}
-	}(&tgdeleteMessages)
+	var audioFormat, audioSmallestFormat ytdl.Format
 
 	for _, f := range vinfo.Formats.WithAudioChannels() {
 		if !strings.Contains(f.MimeType, "/mp4") {
@@ -1128,44 +1462,59 @@ func postAudio(v YtVideo, vinfo *ytdl.Video, m TgMessage) error {
 		if !strings.HasPrefix(f.MimeType, "audio/mp4") {
 			continue
 		}
-		flang := strings.ToLower(f.LanguageDisplayName())
-		log("format: ContentLength:%dmb Language:%#v", f.ContentLength>>20, flang)
-		if flang != "" {
-			skip := true
-			for _, l := range Config.YtDownloadLanguages {
-				if strings.Contains(flang, l) {
-					skip = false
-				}
-			}
-			if skip {
-				continue
-			}
+		if !ytlanguageok(ctx, f) {
+			continue
 		}
 		if audioSmallestFormat.ItagNo == 0 || f.Bitrate < audioSmallestFormat.Bitrate {
 			audioSmallestFormat = f
 		}
-		if fsize < Config.TgMaxFileSizeBytes && f.Bitrate > audioFormat.Bitrate {
+		if fsize < maxfilesize && f.Bitrate > audioFormat.Bitrate {
 			audioFormat = f
 		}
 	}
 
-	var targetAudioBitrateKbps int64
+	var target FfmpegTarget
 	if audioFormat.ItagNo == 0 {
 		audioFormat = audioSmallestFormat
-		targetAudioBitrateKbps = int64(((Config.TgMaxFileSizeBytes * 8) / int64(vinfo.Duration.Seconds()+1)) / 1024)
+		target = ffmpegTargetAudio(maxfilesize, vinfo.Duration)
+	}
+	transcode := config.FfmpegPath != "" && target.AudioBitrateKbps > 0
+	pipeline := transcode && config.FfmpegPipeline && ffmpegPipelineSource(audioFormat)
+	if transcode && config.FfmpegPipeline && !pipeline {
+		logctx(ctx, "format %s cannot be piped into ffmpeg, transcoding from the file", audioFormat.MimeType)
+	}
+	if pipeline && pipelineupload {
+		target = ffmpegTargetAudio(ffmpegPipelineUploadSize(), vinfo.Duration)
+	}
+
+	need := ytformatSize(audioFormat, vinfo.Duration)
+	if transcode {
+		need += maxfilesize
+	}
+	if pipeline {
+		// the original is not written to disk and the output only if it is not uploaded as it is transcoded
+		need = 0
+		if !pipelineupload {
+			need = maxfilesize
+		}
+	}
+	if err := workdirCheck(job.Dir, need); err != nil {
+		return fmt.Errorf("workdirCheck: %w", err)
 	}
 
-	ytstream, ytstreamsize, err := YtdlCl.GetStreamContext(Ctx, vinfo, &audioFormat)
+	ytstream, err := ytstreamOpen(ctx, job.Ytdl, vinfo, &audioFormat)
 	if err != nil {
-		return fmt.Errorf("GetStreamContext: %w", err)
+		return fmt.Errorf("ytstreamOpen: %w", err)
 	}
 	defer ytstream.Close()
+	ytstreamsize := ytstream.Size
 
 	if ytstreamsize == 0 {
-		return fmt.Errorf("GetStreamContext: stream size is zero")
+		return fmt.Errorf("ytstreamOpen: stream size is zero")
 	}
 
-	log(
+	logctx(
+		ctx,
 		"downloading youtu.be/%s audio size:%dmb bitrate:%dkbps duration:%s language:%#v",
 		v.Id,
 		ytstreamsize>>20,
@@ -1188,102 +1537,332 @@ func postAudio(v YtVideo, vinfo *ytdl.Video, m TgMessage) error {
 		)
 	}
 
-	tgaudioFilename := fmt.Sprintf("%s.%s.m4a", ts(), v.Id)
-	tgaudioFile, err := os.OpenFile(tgaudioFilename, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return fmt.Errorf("create file: %w", err)
+	job.Format = fmt.Sprintf("%s %dkbps", audioFormat.MimeType, audioFormat.Bitrate/1024)
+
+	sendaudio := func(path string, r io.Reader) (err error) {
+		tgaudio, err = tgsendAudioFile(
+			ctx,
+			m.Chat.Id,
+			tgaudioCaption,
+			path,
+			r,
+			progress,
+			vinfo.Author,
+			vinfo.Title,
+			vinfo.Duration,
+		)
+		return err
 	}
 
-	/*
-		if Config.DEBUG {
-			downloadingmessagetext := fmt.Sprintf("%s"+NL+"youtu.be/%s %s %dkbps"+NL+"downloading", vinfo.Title, v.Id, vinfo.Duration, audioFormat.Bitrate/1024)
-			if v.PlaylistId != "" && v.PlaylistTitle != "" {
-				downloadingmessagetext = fmt.Sprintf("%d/%d %s "+NL, v.PlaylistIndex+1, v.PlaylistSize, v.PlaylistTitle) + downloadingmessagetext
-			}
-			if downloadingmessage, err := tgsendMessage(downloadingmessagetext, m.Chat.Id, "", 0); err == nil && downloadingmessage != nil {
-				tgdeleteMessages = append(tgdeleteMessages, TgChatMessageId{m.Chat.Id, downloadingmessage.MessageId})
-			}
+	transcoded := func(target FfmpegTarget) {
+		tgaudioCaption += NL + fmt.Sprintf("(transcoded to %s)", target)
+		job.Format += " transcoded " + target.String()
+	}
+
+	if pipeline {
+		filename2 := filepath.Join(job.Dir, v.Id+".transcoded.m4a")
+		defer removeFile(filename2)
+
+		var upload func(io.Reader) error
+		if pipelineupload {
+			transcoded(target)
+			upload = func(r io.Reader) error { return sendaudio("", r) }
 		}
-	*/
 
-	t0 := time.Now()
-	_, err = io.Copy(tgaudioFile, ytstream)
+		progress.Header(fmt.Sprintf("%s"+NL+"youtu.be/%s %s %dkbps", vinfo.Title, v.Id, vinfo.Duration, audioFormat.Bitrate/1024))
+		progress.Stage(fmt.Sprintf("downloading and transcoding to %s", target), int64(vinfo.Duration.Seconds()), "%")
+
+		t0 := time.Now()
+		written, err := FfmpegPipeline(ctx, ytstream, filename2, target, progress, upload)
+		job.Bytes += written
+		if err != nil {
+			return fmt.Errorf("FfmpegPipeline: %w", err)
+		}
+		MetricDownloadDuration.ObserveSince(t0, "audio")
+		logctx(ctx, "downloaded and transcoded youtu.be/%s audio in %v", v.Id, time.Since(t0).Truncate(time.Second))
+
+		if upload == nil {
+			target, err = ffmpegFitSize(ctx, "", filename2, target, audioFormat, vinfo.Duration, progress)
+			if err != nil {
+				return fmt.Errorf("ffmpegFitSize: %w", err)
+			}
+			transcoded(target)
+			if err := sendaudio(filename2, nil); err != nil {
+				return fmt.Errorf("tgsendAudioFile: %w", err)
+			}
+		}
+		return nil
+	}
+
+	tgaudioFilename := filepath.Join(job.Dir, v.Id+".m4a")
+	tgaudioFile, err := os.OpenFile(tgaudioFilename, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	defer removeFile(tgaudioFilename)
+
+	progress.Header(fmt.Sprintf("%s"+NL+"youtu.be/%s %s %dkbps", vinfo.Title, v.Id, vinfo.Duration, audioFormat.Bitrate/1024))
+	progress.Stage("downloading", ytstreamsize, "mb")
+
+	t0 := time.Now()
+	written, err := io.Copy(tgaudioFile, &ProgressReader{Reader: ytstream, Progress: progress})
+	job.Bytes += written
+	if err != nil {
+		tgaudioFile.Close()
 		return fmt.Errorf("download youtu.be/%s audio: %w", v.Id, err)
 	}
 
 	if err := ytstream.Close(); err != nil {
-		log("ytstream.Close: %v", err)
+		logctx(ctx, "ytstream.Close: %v", err)
 	}
 	if err := tgaudioFile.Close(); err != nil {
 		return fmt.Errorf("os.File.Close: %w", err)
 	}
 
-	log("downloaded youtu.be/%s audio in %v", v.Id, time.Since(t0).Truncate(time.Second))
-	/*
-		if Config.DEBUG {
-			downloadedmessagetext := fmt.Sprintf("%s"+NL+"youtu.be/%s %s %dkbps"+NL+"downloaded audio in %s", vinfo.Title, v.Id, vinfo.Duration, audioFormat.Bitrate/1024, time.Since(t0).Truncate(time.Second))
-			if targetAudioBitrateKbps > 0 {
-				downloadedmessagetext += NL + fmt.Sprintf("transcoding to audio:%dkbps", targetAudioBitrateKbps)
-			}
-			downloadedmessage, err := tgsendMessage(downloadedmessagetext, m.Chat.Id, "", 0)
-			if err == nil && downloadedmessage != nil {
-				tgdeleteMessages = append(tgdeleteMessages, TgChatMessageId{m.Chat.Id, downloadedmessage.MessageId})
-			}
-		}
-	*/
+	MetricDownloadDuration.ObserveSince(t0, "audio")
+	logctx(ctx, "downloaded youtu.be/%s audio in %v", v.Id, time.Since(t0).Truncate(time.Second))
 
-	if Config.FfmpegPath != "" && targetAudioBitrateKbps > 0 {
-		filename2 := fmt.Sprintf("%s.%s.a%dk.m4a", ts(), v.Id, targetAudioBitrateKbps)
-		err := FfmpegTranscode(tgaudioFilename, filename2, 0, targetAudioBitrateKbps)
+	if transcode {
+		filename2 := filepath.Join(job.Dir, v.Id+".transcoded.m4a")
+		defer removeFile(filename2)
+		progress.Stage(fmt.Sprintf("transcoding to %s", target), int64(vinfo.Duration.Seconds()), "%")
+		err := FfmpegTranscode(ctx, tgaudioFilename, filename2, nil, nil, target, progress)
 		if err != nil {
 			return fmt.Errorf("FfmpegTranscode `%s`: %w", tgaudioFilename, err)
 		}
-		tgaudioCaption += NL + fmt.Sprintf("(transcoded to audio:%dkbps)", targetAudioBitrateKbps)
-		if err := os.Remove(tgaudioFilename); err != nil {
-			log("os.Remove `%s`: %v", tgaudioFilename, err)
+		target, err = ffmpegFitSize(ctx, tgaudioFilename, filename2, target, audioFormat, vinfo.Duration, progress)
+		if err != nil {
+			return fmt.Errorf("ffmpegFitSize: %w", err)
 		}
+		transcoded(target)
+		removeFile(tgaudioFilename)
 		tgaudioFilename = filename2
 	}
 
-	tgaudioReader, err := os.Open(tgaudioFilename)
+	err = sendaudio(tgaudioFilename, nil)
 	if err != nil {
-		return fmt.Errorf("os.Open: %w", err)
+		return fmt.Errorf("tgsendAudioFile: %w", err)
+	}
+
+	if tgaudio == nil {
+		return fmt.Errorf("tgsendAudioFile: result is nil")
+	}
+	if tgaudio.FileId == "" {
+		return fmt.Errorf("tgsendAudioFile: file_id empty")
 	}
-	defer tgaudioReader.Close()
 
-	tgaudio, err = tgsendAudioFile(
-		m.Chat.Id,
-		tgaudioCaption,
-		tgaudioReader,
-		vinfo.Author,
-		vinfo.Title,
+	return nil
+}
+
+func postRaw(job *Job, v YtVideo, vinfo *ytdl.Video) error {
+	ctx := logWith(job.Ctx, "video_id", v.Id)
+	config, maxfilesize := Config(), tgmaxfilesize()
+	m, progress, video := job.Message, job.Progress, job.Video
+
+	var rawFormat ytdl.Format
+	for _, f := range vinfo.Formats.WithAudioChannels() {
+		if video {
+			if !strings.HasPrefix(f.MimeType, "video/") || f.QualityLabel == "" {
+				continue
+			}
+		} else {
+			if !strings.HasPrefix(f.MimeType, "audio/") {
+				continue
+			}
+		}
+		if !ytlanguageok(ctx, f) {
+			continue
+		}
+		if f.Bitrate > rawFormat.Bitrate {
+			rawFormat = f
+		}
+	}
+	if rawFormat.ItagNo == 0 {
+		return ErrNoFormat
+	}
+
+	fsize := ytformatSize(rawFormat, vinfo.Duration)
+	if fsize > maxfilesize && !config.TgRawSplitParts {
+		return fmt.Errorf("file size %dmb exceeds the telegram limit of %dmb: %w", fsize>>20, maxfilesize>>20, ErrTooLarge)
+	}
+
+	// a split file needs the space for one part more
+	need := fsize
+	if fsize > maxfilesize {
+		need += maxfilesize
+	}
+	if err := workdirCheck(job.Dir, need); err != nil {
+		return fmt.Errorf("workdirCheck: %w", err)
+	}
+
+	ytstream, err := ytstreamOpen(ctx, job.Ytdl, vinfo, &rawFormat)
+	if err != nil {
+		return fmt.Errorf("ytstreamOpen: %w", err)
+	}
+	defer ytstream.Close()
+	ytstreamsize := ytstream.Size
+
+	logctx(
+		ctx,
+		"downloading youtu.be/%s raw size:%dmb mimetype:%s bitrate:%dkbps duration:%s language:%#v",
+		v.Id,
+		ytstreamsize>>20,
+		rawFormat.MimeType,
+		rawFormat.Bitrate>>10,
 		vinfo.Duration,
+		rawFormat.LanguageDisplayName(),
+	)
+
+	tgdocumentCaption := fmt.Sprintf(
+		"%s %s"+NL+
+			"youtu.be/%s %s %s %dkbps ",
+		vinfo.Title, vinfo.PublishDate.Format("2006/01/02"),
+		v.Id, vinfo.Duration, rawFormat.MimeType, rawFormat.Bitrate/1024,
 	)
+	if v.PlaylistId != "" && v.PlaylistTitle != "" {
+		tgdocumentCaption += NL + fmt.Sprintf(
+			"%d/%d %s ",
+			v.PlaylistIndex+1, v.PlaylistSize, v.PlaylistTitle,
+		)
+	}
+
+	job.Format = fmt.Sprintf("%s %s %dkbps", rawFormat.MimeType, rawFormat.QualityLabel, rawFormat.Bitrate/1024)
+
+	tgdocumentName := ytfilename(vinfo.Title, v.Id, ytmimeext(rawFormat.MimeType))
+
+	// the file has the name of the document so a local telegram api server that takes the path sends it with this name
+	tgdocumentFilename := filepath.Join(job.Dir, tgdocumentName)
+	tgdocumentFile, err := os.OpenFile(tgdocumentFilename, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
-		return fmt.Errorf("tgsendAudioFile: %w", err)
+		return fmt.Errorf("os.OpenFile: %w", err)
 	}
+	defer removeFile(tgdocumentFilename)
+
+	progress.Header(fmt.Sprintf("%s"+NL+"youtu.be/%s %s %s", vinfo.Title, v.Id, vinfo.Duration, rawFormat.MimeType))
+	progress.Stage("downloading", ytstreamsize, "mb")
 
-	if err := tgaudioReader.Close(); err != nil {
-		log("os.File.Close: %v", err)
+	t0 := time.Now()
+	downloadsize, err := io.Copy(tgdocumentFile, &ProgressReader{Reader: ytstream, Progress: progress})
+	job.Bytes += downloadsize
+	if err != nil {
+		tgdocumentFile.Close()
+		return fmt.Errorf("download youtu.be/%s raw: %w", v.Id, err)
+	}
+
+	if err := ytstream.Close(); err != nil {
+		logctx(ctx, "ytstream.Close: %v", err)
 	}
-	if err := os.Remove(tgaudioFilename); err != nil {
-		log("os.Remove: %v", err)
+	if err := tgdocumentFile.Close(); err != nil {
+		return fmt.Errorf("os.File.Close: %w", err)
 	}
 
-	if tgaudio == nil {
-		return fmt.Errorf("tgsendAudioFile: result is nil")
+	MetricDownloadDuration.ObserveSince(t0, "raw")
+	logctx(ctx, "downloaded youtu.be/%s raw in %v", v.Id, time.Since(t0).Truncate(time.Second))
+
+	if downloadsize <= maxfilesize {
+		_, err = tgsendDocumentFile(ctx, m.Chat.Id, tgdocumentCaption, tgdocumentFilename, tgdocumentName, progress)
+		if err != nil {
+			return fmt.Errorf("tgsendDocumentFile: %w", err)
+		}
+		return nil
 	}
-	if tgaudio.FileId == "" {
-		return fmt.Errorf("tgsendAudioFile: file_id empty")
+
+	if !config.TgRawSplitParts {
+		return fmt.Errorf("file size %dmb exceeds the telegram limit of %dmb: %w", downloadsize>>20, maxfilesize>>20, ErrTooLarge)
+	}
+
+	// parts are plain byte ranges of the original file, `cat name.001 name.002 ... >name` restores it
+	parts := (downloadsize + maxfilesize - 1) / maxfilesize
+	logctx(ctx, "splitting youtu.be/%s raw size:%dmb into %d parts", v.Id, downloadsize>>20, parts)
+
+	tgdocumentFile, err = os.Open(tgdocumentFilename)
+	if err != nil {
+		return fmt.Errorf("os.Open: %w", err)
+	}
+	defer tgdocumentFile.Close()
+
+	for part := int64(1); part <= parts; part++ {
+		partFilename := fmt.Sprintf("%s.%03d", tgdocumentFilename, part)
+		partFile, err := os.OpenFile(partFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("os.OpenFile: %w", err)
+		}
+		_, err = io.CopyN(partFile, tgdocumentFile, maxfilesize)
+		if err != nil && err != io.EOF {
+			partFile.Close()
+			removeFile(partFilename)
+			return fmt.Errorf("io.CopyN part %d: %w", part, err)
+		}
+		if err := partFile.Close(); err != nil {
+			removeFile(partFilename)
+			return fmt.Errorf("os.File.Close: %w", err)
+		}
+
+		_, err = tgsendDocumentFile(
+			ctx,
+			m.Chat.Id,
+			tgdocumentCaption+NL+fmt.Sprintf("part %d/%d", part, parts),
+			partFilename,
+			fmt.Sprintf("%s.%03d", tgdocumentName, part),
+			progress,
+		)
+		removeFile(partFilename)
+		if err != nil {
+			return fmt.Errorf("tgsendDocumentFile part %d/%d: %w", part, parts, err)
+		}
 	}
 
 	return nil
 }
 
+func ytlanguageok(ctx context.Context, f ytdl.Format) bool {
+	flang := strings.ToLower(f.LanguageDisplayName())
+	logctx(ctx, "format: ContentLength:%dmb Language:%#v", f.ContentLength>>20, flang)
+	if flang == "" {
+		return true
+	}
+	for _, l := range Config().YtDownloadLanguages {
+		if strings.Contains(flang, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func ytmimeext(mimetype string) string {
+	mimetype, _, _ = strings.Cut(mimetype, ";")
+	switch strings.TrimSpace(mimetype) {
+	case "audio/mp4":
+		return "m4a"
+	case "video/mp4":
+		return "mp4"
+	case "audio/webm", "video/webm":
+		return "webm"
+	case "video/3gpp":
+		return "3gp"
+	}
+	return "bin"
+}
+
+func ytfilename(title, id, ext string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(title))
+	if len([]rune(name)) > 100 {
+		name = strings.TrimSpace(string([]rune(name)[:100]))
+	}
+	if name == "" {
+		return fmt.Sprintf("%s.%s", id, ext)
+	}
+	return fmt.Sprintf("%s.%s.%s", name, id, ext)
+}
+
 func getList(ytlistid string) (ytitems []YtVideo, err error) {
 	// https://developers.google.com/youtube/v3/docs/playlists
-	var PlaylistUrl = fmt.Sprintf("https://www.googleapis.com/youtube/v3/playlists?maxResults=%d&part=snippet&id=%s&key=%s", Config.YtMaxResults, ytlistid, Config.YtKey)
+	var PlaylistUrl = fmt.Sprintf("https://www.googleapis.com/youtube/v3/playlists?maxResults=%d&part=snippet&id=%s&key=%s", Config().YtMaxResults, ytlistid, Config().YtKey)
 	var playlists YtPlaylists
 	err = getJson(PlaylistUrl, &playlists, nil)
 	if err != nil {
@@ -1301,12 +1880,12 @@ func getList(ytlistid string) (ytitems []YtVideo, err error) {
 
 	listtitle := playlists.Items[0].Snippet.Title
 
-	var videos []YtPlaylistItemSnippet
+	var videos []YtPlaylistItem
 	nextPageToken := ""
 
 	for nextPageToken != "" || len(videos) == 0 {
 		// https://developers.google.com/youtube/v3/docs/playlistItems
-		var PlaylistItemsUrl = fmt.Sprintf("https://www.googleapis.com/youtube/v3/playlistItems?maxResults=%d&part=snippet&playlistId=%s&key=%s&pageToken=%s", Config.YtMaxResults, ytlistid, Config.YtKey, nextPageToken)
+		var PlaylistItemsUrl = fmt.Sprintf("https://www.googleapis.com/youtube/v3/playlistItems?maxResults=%d&part=snippet,contentDetails&playlistId=%s&key=%s&pageToken=%s", Config().YtMaxResults, ytlistid, Config().YtKey, nextPageToken)
 
 		var playlistItems YtPlaylistItems
 		err = getJson(PlaylistItemsUrl, &playlistItems, nil)
@@ -1320,18 +1899,28 @@ func getList(ytlistid string) (ytitems []YtVideo, err error) {
 			nextPageToken = ""
 		}
 
-		for _, i := range playlistItems.Items {
-			videos = append(videos, i.Snippet)
-		}
+		videos = append(videos, playlistItems.Items...)
 	}
 
 	//sort.Slice(videos, func(i, j int) bool { return videos[i].PublishedAt < videos[j].PublishedAt })
 
+	var ids []string
 	for _, vid := range videos {
+		ids = append(ids, vid.Snippet.ResourceId.VideoId)
+	}
+	durations, err := ytgetDurations(ids)
+	if err != nil {
+		log("WARNING ytgetDurations: %v", err)
+	}
+
+	for _, item := range videos {
+		vid := item.Snippet
 		ytitems = append(
 			ytitems,
 			YtVideo{
 				Id:            vid.ResourceId.VideoId,
+				PublishedAt:   item.ContentDetails.VideoPublishedAt,
+				Duration:      durations[vid.ResourceId.VideoId],
 				PlaylistId:    vid.PlaylistId,
 				PlaylistIndex: vid.Position,
 				PlaylistSize:  int64(len(videos)),
@@ -1343,6 +1932,164 @@ func getList(ytlistid string) (ytitems []YtVideo, err error) {
 	return ytitems, nil
 }
 
+func ytgetDurations(ids []string) (durations map[string]time.Duration, err error) {
+	// https://developers.google.com/youtube/v3/docs/videos/list
+	durations = make(map[string]time.Duration)
+	for len(ids) > 0 {
+		n := min(len(ids), 50)
+		var VideosUrl = fmt.Sprintf("https://www.googleapis.com/youtube/v3/videos?part=contentDetails&id=%s&key=%s", strings.Join(ids[:n], ","), Config().YtKey)
+		ids = ids[n:]
+
+		var videos YtVideoListResponse
+		err = getJson(VideosUrl, &videos, nil)
+		if err != nil {
+			return durations, err
+		}
+
+		for _, v := range videos.Items {
+			d, err := ytparseDuration(v.ContentDetails.Duration)
+			if err != nil {
+				log("WARNING ytparseDuration `%s`: %v", v.ContentDetails.Duration, err)
+				continue
+			}
+			durations[v.Id] = d
+		}
+	}
+	return durations, nil
+}
+
+// ytparseDuration parses ISO 8601 durations like P1DT2H3M4S as returned by youtube api
+func ytparseDuration(s string) (d time.Duration, err error) {
+	if !strings.HasPrefix(s, "P") {
+		return 0, fmt.Errorf("no P prefix")
+	}
+	var intime bool
+	var num string
+	for _, r := range s[1:] {
+		switch {
+		case r == 'T':
+			intime = true
+		case unicode.IsDigit(r):
+			num += string(r)
+		default:
+			n, err := strconv.ParseInt(num, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid number before %c", r)
+			}
+			num = ""
+			switch {
+			case r == 'W' && !intime:
+				d += time.Duration(n) * 7 * 24 * time.Hour
+			case r == 'D' && !intime:
+				d += time.Duration(n) * 24 * time.Hour
+			case r == 'H' && intime:
+				d += time.Duration(n) * time.Hour
+			case r == 'M' && intime:
+				d += time.Duration(n) * time.Minute
+			case r == 'S' && intime:
+				d += time.Duration(n) * time.Second
+			default:
+				return 0, fmt.Errorf("unsupported designator %c", r)
+			}
+		}
+	}
+	return d, nil
+}
+
+// ytlistoptions parses playlist options like `items=5-20 reverse=yes shuffle=yes latest=10 since=2024-01-01 new=yes`
+// from the message text, only the words with `=` are options so the usual words of a message do not turn them on
+func ytlistoptions(text string) (o YtListOptions, err error) {
+	yes := func(k, v string) (bool, error) {
+		switch v {
+		case "yes":
+			return true, nil
+		case "no":
+			return false, nil
+		}
+		return false, fmt.Errorf("invalid %s `%s`, should be %s=yes or %s=no", k, v, k, k)
+	}
+	for _, w := range strings.Fields(strings.ToLower(text)) {
+		k, v, ok := strings.Cut(w, "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "items":
+			from, to, isrange := strings.Cut(v, "-")
+			if o.ItemsFrom, err = strconv.ParseInt(from, 10, 64); err != nil || o.ItemsFrom < 1 {
+				return o, fmt.Errorf("invalid items `%s`, should be like items=5-20", v)
+			}
+			if !isrange {
+				o.ItemsTo = o.ItemsFrom
+			} else if to != "" {
+				if o.ItemsTo, err = strconv.ParseInt(to, 10, 64); err != nil || o.ItemsTo < o.ItemsFrom {
+					return o, fmt.Errorf("invalid items `%s`, should be like items=5-20", v)
+				}
+			}
+		case "reverse":
+			if o.Reverse, err = yes(k, v); err != nil {
+				return o, err
+			}
+		case "shuffle":
+			if o.Shuffle, err = yes(k, v); err != nil {
+				return o, err
+			}
+		case "latest":
+			if o.Latest, err = strconv.Atoi(v); err != nil || o.Latest < 1 {
+				return o, fmt.Errorf("invalid latest `%s`, should be like latest=10", v)
+			}
+		case "since":
+			if _, err = time.Parse("2006-01-02", v); err != nil {
+				return o, fmt.Errorf("invalid since `%s`, should be like since=2024-01-01", v)
+			}
+			o.Since = v
+		case "new":
+			if o.New, err = yes(k, v); err != nil {
+				return o, err
+			}
+		}
+	}
+	return o, nil
+}
+
+func ytlistfilter(videos []YtVideo, o YtListOptions, chatid int64) []YtVideo {
+	var selected []YtVideo
+	for _, v := range videos {
+		if o.ItemsFrom > 0 && v.PlaylistIndex+1 < o.ItemsFrom {
+			continue
+		}
+		if o.ItemsTo > 0 && v.PlaylistIndex+1 > o.ItemsTo {
+			continue
+		}
+		// PublishedAt is RFC 3339 so the date prefix compares as a string
+		if o.Since != "" && v.PublishedAt < o.Since {
+			continue
+		}
+		if o.New && statePosted(chatid, v.Id) {
+			continue
+		}
+		selected = append(selected, v)
+	}
+
+	if o.Latest > 0 && len(selected) > o.Latest {
+		latest := slices.Clone(selected)
+		sort.SliceStable(latest, func(i, j int) bool { return latest[i].PublishedAt > latest[j].PublishedAt })
+		latest = latest[:o.Latest]
+		selected = slices.DeleteFunc(selected, func(v YtVideo) bool {
+			return !slices.ContainsFunc(latest, func(l YtVideo) bool { return l.Id == v.Id })
+		})
+	}
+
+	if o.Reverse {
+		slices.Reverse(selected)
+	}
+	if o.Shuffle {
+		rand.Shuffle(len(selected), func(i, j int) { selected[i], selected[j] = selected[j], selected[i] })
+	}
+
+	return selected
+}
+
 func safestring(s string) (t string) {
 	for _, r := range s {
 		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
@@ -1358,115 +2105,135 @@ func safestring(s string) (t string) {
 	return t
 }
 
-func tgsendVideoFile(chatid int64, caption string, video io.Reader, width, height int, duration time.Duration) (tgvideo *TgVideo, err error) {
-	piper, pipew := io.Pipe()
-	mpartw := multipart.NewWriter(pipew)
-
-	var mparterr error
-	go func(err error) {
-		defer func() {
-			if mparterr != nil {
-				log("mparterr: %v", err)
-			}
-		}()
-
-		var formw io.Writer
-
-		defer pipew.Close()
+type TgFormField struct {
+	Name  string
+	Value string
+}
 
-		// chat_id
-		formw, err = mpartw.CreateFormField("chat_id")
-		if err != nil {
-			err = fmt.Errorf("CreateFormField(`chat_id`): %w", err)
-			return
-		}
-		_, err = formw.Write([]byte(strconv.Itoa(int(chatid))))
+// tgsendFile uploads the file at the path, or the reader if it is not nil as it is read without knowing the size ahead
+func tgsendFile(ctx context.Context, method string, fields []TgFormField, filefield, filename, path string, reader io.Reader, progress *TgProgress) (msg *TgMessage, err error) {
+	// https://core.telegram.org/bots/api#sending-files
+	t0 := time.Now()
+	var uploaded int64
+	MetricApiRequests.Inc("telegram", method)
+	errdescription := "request failed"
+	defer func() {
 		if err != nil {
-			err = fmt.Errorf("Write(chat_id): %w", err)
+			MetricTgApiErrors.Inc(method, metricsNumberRe.ReplaceAllString(errdescription, "N"))
 			return
 		}
+		MetricUploadDuration.ObserveSince(t0, method)
+		MetricUploadBytes.Add(float64(uploaded))
+	}()
 
-		// caption
-		formw, err = mpartw.CreateFormField("caption")
-		if err != nil {
-			err = fmt.Errorf("CreateFormField(`caption`): %w", err)
-			return
-		}
-		_, err = formw.Write([]byte(caption))
-		if err != nil {
-			err = fmt.Errorf("Write(caption): %w", err)
-			return
-		}
+	piper, pipew := io.Pipe()
+	mpartw := multipart.NewWriter(pipew)
 
-		// width
-		formw, err = mpartw.CreateFormField("width")
-		if err != nil {
-			err = fmt.Errorf("CreateFormField(`width`): %w", err)
-			return
-		}
-		_, err = formw.Write([]byte(strconv.Itoa(width)))
-		if err != nil {
-			err = fmt.Errorf("Write(width): %w", err)
-			return
-		}
+	go func() {
+		var err error
+		var formw io.Writer
 
-		// height
-		formw, err = mpartw.CreateFormField("height")
-		if err != nil {
-			err = fmt.Errorf("CreateFormField(`height`): %w", err)
-			return
-		}
-		_, err = formw.Write([]byte(strconv.Itoa(height)))
-		if err != nil {
-			err = fmt.Errorf("Write(height): %w", err)
-			return
-		}
+		defer func() {
+			if err != nil {
+				logctx(ctx, "%s multipart: %v", method, err)
+				pipew.CloseWithError(err)
+				return
+			}
+			pipew.Close()
+		}()
 
-		// video
-		formw, err = mpartw.CreateFormFile("video", safestring(caption))
-		if err != nil {
-			err = fmt.Errorf("CreateFormFile('video'): %w", err)
-			return
-		}
-		_, err = io.Copy(formw, video)
-		if err != nil {
-			err = fmt.Errorf("Copy video: %w", err)
-			return
+		for _, f := range fields {
+			formw, err = mpartw.CreateFormField(f.Name)
+			if err != nil {
+				err = fmt.Errorf("CreateFormField(`%s`): %w", f.Name, err)
+				return
+			}
+			_, err = formw.Write([]byte(f.Value))
+			if err != nil {
+				err = fmt.Errorf("Write(%s): %w", f.Name, err)
+				return
+			}
 		}
 
-		// duration
-		formw, err = mpartw.CreateFormField("duration")
-		if err != nil {
-			err = fmt.Errorf("CreateFormField(`duration`): %w", err)
-			return
-		}
-		_, err = formw.Write([]byte(strconv.Itoa(int(duration.Seconds()))))
-		if err != nil {
-			err = fmt.Errorf("Write(duration): %w", err)
-			return
+		if reader != nil {
+			formw, err = mpartw.CreateFormFile(filefield, filename)
+			if err != nil {
+				err = fmt.Errorf("CreateFormFile(`%s`): %w", filefield, err)
+				return
+			}
+			uploaded, err = io.Copy(formw, reader)
+			if err != nil {
+				err = fmt.Errorf("Copy %s: %w", filefield, err)
+				return
+			}
+		} else if Config().TgApiLocal {
+			// https://github.com/tdlib/telegram-bot-api#usage
+			var fileabspath string
+			fileabspath, err = filepath.Abs(path)
+			if err != nil {
+				err = fmt.Errorf("filepath.Abs `%s`: %w", path, err)
+				return
+			}
+			formw, err = mpartw.CreateFormField(filefield)
+			if err != nil {
+				err = fmt.Errorf("CreateFormField(`%s`): %w", filefield, err)
+				return
+			}
+			_, err = formw.Write([]byte("file://" + fileabspath))
+			if err != nil {
+				err = fmt.Errorf("Write(%s): %w", filefield, err)
+				return
+			}
+			progress.Stage("uploading", 0, "")
+		} else {
+			var file *os.File
+			file, err = os.Open(path)
+			if err != nil {
+				err = fmt.Errorf("os.Open: %w", err)
+				return
+			}
+			defer file.Close()
+			var filesize int64
+			if fileinfo, err := file.Stat(); err == nil {
+				filesize = fileinfo.Size()
+			}
+			formw, err = mpartw.CreateFormFile(filefield, filename)
+			if err != nil {
+				err = fmt.Errorf("CreateFormFile(`%s`): %w", filefield, err)
+				return
+			}
+			progress.Stage("uploading", filesize, "mb")
+			uploaded, err = io.Copy(formw, &ProgressReader{Reader: file, Progress: progress})
+			if err != nil {
+				err = fmt.Errorf("Copy %s: %w", filefield, err)
+				return
+			}
 		}
 
-		if err := mpartw.Close(); err != nil {
+		if err = mpartw.Close(); err != nil {
 			err = fmt.Errorf("multipart.Writer.Close: %w", err)
 			return
 		}
-	}(mparterr)
-
-	t0 := time.Now()
+	}()
 
-	resp, err := HttpClient.Post(
-		fmt.Sprintf("%s/bot%s/sendVideo", Config.TgApiUrlBase, Config.TgToken),
-		mpartw.FormDataContentType(),
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf("%s/bot%s/%s", Config().TgApiUrlBase, Config().TgToken, method),
 		piper,
 	)
 	if err != nil {
+		piper.CloseWithError(err)
 		return nil, err
 	}
-	defer resp.Body.Close()
+	req.Header.Set("Content-Type", mpartw.FormDataContentType())
 
-	if mparterr != nil {
+	resp, err := HttpClient.Do(req)
+	if err != nil {
+		piper.CloseWithError(err)
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	var tgresp TgResponse
 	err = json.NewDecoder(resp.Body).Decode(&tgresp)
@@ -1474,166 +2241,124 @@ func tgsendVideoFile(chatid int64, caption string, video io.Reader, width, heigh
 		return nil, fmt.Errorf("Decode: %w", err)
 	}
 	if !tgresp.Ok {
-		return nil, fmt.Errorf("sendVideo: %s", tgresp.Description)
+		errdescription = tgresp.Description
+		if strings.HasPrefix(tgresp.Description, "Too Many Requests: retry after ") {
+			logctx(ctx, "WARNING telegram api too many requests: sleeping 33 seconds")
+			time.Sleep(33 * time.Second)
+		}
+		return nil, fmt.Errorf("%s: %s", method, tgresp.Description)
+	}
+	if tgresp.Result == nil {
+		return nil, fmt.Errorf("%s: result is nil", method)
+	}
+
+	return tgresp.Result, nil
+}
+
+func tgsendVideoFile(ctx context.Context, chatid int64, caption string, videopath string, video io.Reader, progress *TgProgress, width, height int, duration time.Duration) (tgvideo *TgVideo, err error) {
+	t0 := time.Now()
+
+	msg, err := tgsendFile(
+		ctx,
+		"sendVideo",
+		[]TgFormField{
+			{"chat_id", strconv.FormatInt(chatid, 10)},
+			{"caption", caption},
+			{"width", strconv.Itoa(width)},
+			{"height", strconv.Itoa(height)},
+			{"duration", strconv.Itoa(int(duration.Seconds()))},
+		},
+		"video", safestring(caption), videopath, video, progress,
+	)
+	if err != nil {
+		return nil, err
 	}
 
-	msg := tgresp.Result
 	tgvideo = &msg.Video
 	if tgvideo.FileId == "" {
 		return nil, fmt.Errorf("sendVideo: Video.FileId empty")
 	}
 
-	log("sent the video to telegram in %v", time.Since(t0).Truncate(time.Second))
+	logctx(ctx, "sent the video to telegram in %v", time.Since(t0).Truncate(time.Second))
 
 	return tgvideo, nil
 }
 
-func tgsendAudioFile(chatid int64, caption string, audio io.Reader, performer, title string, duration time.Duration) (tgaudio *TgAudio, err error) {
-	piper, pipew := io.Pipe()
-	mpartw := multipart.NewWriter(pipew)
-
-	var mparterr error
-	go func(err error) {
-		defer func() {
-			if mparterr != nil {
-				log("mparterr: %v", err)
-			}
-		}()
-
-		var formw io.Writer
-
-		defer pipew.Close()
-
-		// chat_id
-		formw, err = mpartw.CreateFormField("chat_id")
-		if err != nil {
-			err = fmt.Errorf("CreateFormField(`chat_id`): %w", err)
-			return
-		}
-		_, err = formw.Write([]byte(strconv.Itoa(int(chatid))))
-		if err != nil {
-			err = fmt.Errorf("Write(chat_id): %w", err)
-			return
-		}
-
-		// performer
-		formw, err = mpartw.CreateFormField("performer")
-		if err != nil {
-			err = fmt.Errorf("CreateFormField(`performer`): %w", err)
-			return
-		}
-		_, err = formw.Write([]byte(performer))
-		if err != nil {
-			err = fmt.Errorf("Write(performer): %w", err)
-			return
-		}
-
-		// title
-		formw, err = mpartw.CreateFormField("title")
-		if err != nil {
-			err = fmt.Errorf("CreateFormField(`title`): %w", err)
-			return
-		}
-		_, err = formw.Write([]byte(title))
-		if err != nil {
-			err = fmt.Errorf("Write(title): %w", err)
-			return
-		}
-
-		// caption
-		formw, err = mpartw.CreateFormField("caption")
-		if err != nil {
-			err = fmt.Errorf("CreateFormField(`caption`): %w", err)
-			return
-		}
-		_, err = formw.Write([]byte(caption))
-		if err != nil {
-			err = fmt.Errorf("Write(caption): %w", err)
-			return
-		}
-
-		// audio
-		formw, err = mpartw.CreateFormFile("audio", safestring(fmt.Sprintf("%s.%s", performer, title)))
-		if err != nil {
-			err = fmt.Errorf("CreateFormFile('audio'): %w", err)
-			return
-		}
-		_, err = io.Copy(formw, audio)
-		if err != nil {
-			err = fmt.Errorf("Copy audio: %w", err)
-			return
-		}
-
-		// duration
-		formw, err = mpartw.CreateFormField("duration")
-		if err != nil {
-			err = fmt.Errorf("CreateFormField(`duration`): %w", err)
-			return
-		}
-		_, err = formw.Write([]byte(strconv.Itoa(int(duration.Seconds()))))
-		if err != nil {
-			err = fmt.Errorf("Write(duration): %w", err)
-			return
-		}
-
-		if err := mpartw.Close(); err != nil {
-			err = fmt.Errorf("multipart.Writer.Close: %w", err)
-			return
-		}
-	}(mparterr)
-
+func tgsendAudioFile(ctx context.Context, chatid int64, caption string, audiopath string, audio io.Reader, progress *TgProgress, performer, title string, duration time.Duration) (tgaudio *TgAudio, err error) {
 	t0 := time.Now()
 
-	resp, err := HttpClient.Post(
-		fmt.Sprintf("%s/bot%s/sendAudio", Config.TgApiUrlBase, Config.TgToken),
-		mpartw.FormDataContentType(),
-		piper,
+	msg, err := tgsendFile(
+		ctx,
+		"sendAudio",
+		[]TgFormField{
+			{"chat_id", strconv.FormatInt(chatid, 10)},
+			{"performer", performer},
+			{"title", title},
+			{"caption", caption},
+			{"duration", strconv.Itoa(int(duration.Seconds()))},
+		},
+		"audio", safestring(fmt.Sprintf("%s.%s", performer, title)), audiopath, audio, progress,
 	)
 	if err != nil {
-		if regexp.MustCompile("Too Many Requests: retry after [0-9]+$").MatchString(fmt.Sprintf("%s", err)) {
-			log("WARNING telegram api too many requests: sleeping 33 seconds")
-			time.Sleep(33 * time.Second)
-		}
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if mparterr != nil {
-		return nil, err
+	tgaudio = &msg.Audio
+	if tgaudio.FileId == "" {
+		return nil, fmt.Errorf("sendAudio: Audio.FileId empty")
 	}
 
-	var tgresp TgResponse
-	err = json.NewDecoder(resp.Body).Decode(&tgresp)
+	logctx(ctx, "sent the audio to telegram in %v", time.Since(t0).Truncate(time.Second))
+
+	return tgaudio, nil
+}
+
+func tgsendDocumentFile(ctx context.Context, chatid int64, caption string, documentpath string, documentname string, progress *TgProgress) (tgdocument *TgDocument, err error) {
+	t0 := time.Now()
+
+	msg, err := tgsendFile(
+		ctx,
+		"sendDocument",
+		[]TgFormField{
+			{"chat_id", strconv.FormatInt(chatid, 10)},
+			{"caption", caption},
+			{"disable_content_type_detection", "true"},
+		},
+		"document", documentname, documentpath, nil, progress,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("Decode: %w", err)
-	}
-	if !tgresp.Ok {
-		return nil, fmt.Errorf("sendAudio: %s", tgresp.Description)
+		return nil, err
 	}
 
-	msg := tgresp.Result
-	tgaudio = &msg.Audio
-	if tgaudio.FileId == "" {
-		return nil, fmt.Errorf("sendAudio: Audio.FileId empty")
+	tgdocument = &msg.Document
+	if tgdocument.FileId == "" {
+		return nil, fmt.Errorf("sendDocument: Document.FileId empty")
 	}
 
-	log("sent the audio to telegram in %v", time.Since(t0).Truncate(time.Second))
+	logctx(ctx, "sent the document to telegram in %v", time.Since(t0).Truncate(time.Second))
 
-	return tgaudio, nil
+	return tgdocument, nil
 }
 
 func tgsendMessage(text string, chatid int64, parsemode string, replytomessageid int64) (msg *TgMessage, err error) {
+	return tgsendMessageMarkup(text, chatid, parsemode, replytomessageid, nil)
+}
+
+func tgsendMessageMarkup(text string, chatid int64, parsemode string, replytomessageid int64, markup *TgInlineKeyboardMarkup) (msg *TgMessage, err error) {
 	// https://core.telegram.org/bots/api/#sendmessage
 	// https://core.telegram.org/bots/api/#formatting-options
 	sendMessage := map[string]interface{}{
 		"chat_id":                  chatid,
-		"text":                     text,
+		"text":                     redact(text),
 		"parse_mode":               parsemode,
 		"disable_web_page_preview": true,
 	}
 	if replytomessageid != 0 {
 		sendMessage["reply_to_message_id"] = replytomessageid
 	}
+	if markup != nil {
+		sendMessage["reply_markup"] = markup
+	}
 	sendMessageJSON, err := json.Marshal(sendMessage)
 	if err != nil {
 		return nil, err
@@ -1641,7 +2366,7 @@ func tgsendMessage(text string, chatid int64, parsemode string, replytomessageid
 
 	var tgresp TgResponse
 	err = postJson(
-		fmt.Sprintf("%s/bot%s/sendMessage", Config.TgApiUrlBase, Config.TgToken),
+		fmt.Sprintf("%s/bot%s/sendMessage", Config().TgApiUrlBase, Config().TgToken),
 		bytes.NewBuffer(sendMessageJSON),
 		&tgresp,
 	)
@@ -1658,6 +2383,34 @@ func tgsendMessage(text string, chatid int64, parsemode string, replytomessageid
 	return msg, nil
 }
 
+func tganswerCallbackQuery(callbackqueryid, text string) error {
+	// https://core.telegram.org/bots/api#answercallbackquery
+	answerCallbackQuery := map[string]interface{}{
+		"callback_query_id": callbackqueryid,
+		"text":              text,
+	}
+	answerCallbackQueryJSON, err := json.Marshal(answerCallbackQuery)
+	if err != nil {
+		return err
+	}
+
+	var tgresp TgResponseShort
+	err = postJson(
+		fmt.Sprintf("%s/bot%s/answerCallbackQuery", Config().TgApiUrlBase, Config().TgToken),
+		bytes.NewBuffer(answerCallbackQueryJSON),
+		&tgresp,
+	)
+	if err != nil {
+		return fmt.Errorf("postJson: %w", err)
+	}
+
+	if !tgresp.Ok {
+		return fmt.Errorf("answerCallbackQuery: %s", tgresp.Description)
+	}
+
+	return nil
+}
+
 func tgdeleteMessage(chatid, messageid int64) error {
 	deleteMessage := map[string]interface{}{
 		"chat_id":    chatid,
@@ -1670,7 +2423,7 @@ func tgdeleteMessage(chatid, messageid int64) error {
 
 	var tgresp TgResponseShort
 	err = postJson(
-		fmt.Sprintf("%s/bot%s/deleteMessage", Config.TgApiUrlBase, Config.TgToken),
+		fmt.Sprintf("%s/bot%s/deleteMessage", Config().TgApiUrlBase, Config().TgToken),
 		bytes.NewBuffer(deleteMessageJSON),
 		&tgresp,
 	)
@@ -1685,80 +2438,151 @@ func tgdeleteMessage(chatid, messageid int64) error {
 	return nil
 }
 
-func FfmpegTranscode(filename, filename2 string, videoBitrateKbps, audioBitrateKbps int64) (err error) {
-	if videoBitrateKbps > 0 {
-		log("transcoding to video:%dkbps audio:%dkbps ", videoBitrateKbps, audioBitrateKbps)
-	} else if audioBitrateKbps > 0 {
-		log("transcoding to audio:%dkbps", audioBitrateKbps)
-	} else {
-		return fmt.Errorf("empty both videoBitrateKbps and audioBitrateKbps")
+// FfmpegTranscode transcodes the file to filename2, with stdin the input is read from it and with stdout
+// the output is written to it as fragmented mp4 that does not need seeking, the filenames are not used then.
+// the video bitrate is limited with -maxrate and -bufsize, the two passes are only done with the input file
+func FfmpegTranscode(ctx context.Context, filename, filename2 string, stdin io.Reader, stdout io.Writer, target FfmpegTarget, progress *TgProgress) (err error) {
+	if target.VideoBitrateKbps <= 0 && target.AudioBitrateKbps <= 0 {
+		return fmt.Errorf("empty both VideoBitrateKbps and AudioBitrateKbps")
 	}
+	logctx(ctx, "transcoding to %s", target)
 
-	ffmpegArgs := append(Config.FfmpegGlobalOptions,
-		"-i", filename,
-		"-f", "mp4",
-	)
-	if videoBitrateKbps > 0 {
-		ffmpegArgs = append(ffmpegArgs,
+	progresspipe := "pipe:1"
+	if stdin != nil {
+		filename = "pipe:0"
+	}
+	if stdout != nil {
+		// stdout is the output so the progress goes to the fd 3 from ExtraFiles
+		progresspipe, filename2 = "pipe:3", "pipe:1"
+	}
+
+	var videoArgs []string
+	if target.VideoBitrateKbps > 0 {
+		videoArgs = []string{
 			"-c:v", "h264",
-			"-b:v", fmt.Sprintf("%dk", videoBitrateKbps),
+			"-b:v", fmt.Sprintf("%dk", target.VideoBitrateKbps),
+			"-maxrate", fmt.Sprintf("%dk", target.VideoBitrateKbps),
+			"-bufsize", fmt.Sprintf("%dk", 2*target.VideoBitrateKbps),
+		}
+		if target.Height > 0 {
+			videoArgs = append(videoArgs, "-vf", fmt.Sprintf("scale=-2:%d", target.Height))
+		}
+	}
+
+	t0 := time.Now()
+
+	if target.TwoPass && target.VideoBitrateKbps > 0 && stdin == nil {
+		// the first pass only writes the stats of the video for the second one
+		passlogfile := filename2 + ".passlog"
+		defer removeFile(passlogfile + "-0.log")
+		defer removeFile(passlogfile + "-0.log.mbtree")
+
+		ffmpegArgs := slices.Clone(Config().FfmpegGlobalOptions)
+		ffmpegArgs = append(ffmpegArgs,
+			"-nostats", "-progress", "pipe:1",
+			"-y", "-i", filename,
 		)
+		ffmpegArgs = append(ffmpegArgs, videoArgs...)
+		ffmpegArgs = append(ffmpegArgs,
+			"-pass", "1", "-passlogfile", passlogfile,
+			"-an", "-f", "null", os.DevNull,
+		)
+		if err := ffmpegRun(ctx, ffmpegArgs, nil, nil, progress); err != nil {
+			return fmt.Errorf("first pass: %w", err)
+		}
+
+		videoArgs = append(videoArgs, "-pass", "2", "-passlogfile", passlogfile)
+	}
+
+	ffmpegArgs := slices.Clone(Config().FfmpegGlobalOptions)
+	ffmpegArgs = append(ffmpegArgs,
+		"-nostats", "-progress", progresspipe,
+		"-y", "-i", filename,
+		"-f", "mp4",
+	)
+	if stdout != nil {
+		ffmpegArgs = append(ffmpegArgs, "-movflags", "frag_keyframe+empty_moov+default_base_moof")
 	}
-	if audioBitrateKbps > 0 {
+	ffmpegArgs = append(ffmpegArgs, videoArgs...)
+	if target.AudioBitrateKbps > 0 {
 		ffmpegArgs = append(ffmpegArgs,
 			"-c:a", "aac",
-			"-b:a", fmt.Sprintf("%dk", audioBitrateKbps),
+			"-b:a", fmt.Sprintf("%dk", target.AudioBitrateKbps),
 		)
 	}
 	ffmpegArgs = append(ffmpegArgs,
 		filename2,
 	)
 
-	ffmpegCmd := exec.Command(Config.FfmpegPath, ffmpegArgs...)
+	if err := ffmpegRun(ctx, ffmpegArgs, stdin, stdout, progress); err != nil {
+		return err
+	}
+
+	MetricTranscodeDuration.ObserveSince(t0)
+	logctx(ctx, "transcoded in %v", time.Since(t0).Truncate(time.Second))
+
+	return nil
+}
+
+// ffmpegRun runs ffmpeg with the args, the progress is read from pipe:3 if stdout is the output and from pipe:1 if not
+func ffmpegRun(ctx context.Context, ffmpegArgs []string, stdin io.Reader, stdout io.Writer, progress *TgProgress) (err error) {
+	ffmpegCmd := exec.CommandContext(ctx, Config().FfmpegPath, ffmpegArgs...)
 
 	ffmpegCmdStderrPipe, err := ffmpegCmd.StderrPipe()
 	if err != nil {
 		return fmt.Errorf("ffmpeg StderrPipe: %w", err)
 	}
+	ffmpegCmd.Stdin = stdin
+	var ffmpegCmdProgressPipe io.Reader
+	if stdout != nil {
+		ffmpegCmd.Stdout = stdout
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			return fmt.Errorf("os.Pipe: %w", err)
+		}
+		defer pr.Close()
+		ffmpegCmd.ExtraFiles = []*os.File{pw}
+		ffmpegCmdProgressPipe = pr
+	} else {
+		ffmpegCmdProgressPipe, err = ffmpegCmd.StdoutPipe()
+		if err != nil {
+			return fmt.Errorf("ffmpeg StdoutPipe: %w", err)
+		}
+	}
 
-	t0 := time.Now()
 	err = ffmpegCmd.Start()
+	if stdout != nil {
+		// only ffmpeg keeps the write end open so the progress reader ends when ffmpeg exits
+		ffmpegCmd.ExtraFiles[0].Close()
+	}
 	if err != nil {
-		return fmt.Errorf("ffmpeg Start: %w", err)
+		return &TranscodeError{Err: fmt.Errorf("ffmpeg Start: %w", err)}
 	}
 
-	log("started command `%s`", ffmpegCmd.String())
+	logctx(ctx, "started command `%s`", ffmpegCmd.String())
+
+	ffmpegprogressdone := make(chan struct{})
+	go func() {
+		ffmpegprogress(ffmpegCmdProgressPipe, progress)
+		close(ffmpegprogressdone)
+	}()
 
 	_, err = io.Copy(os.Stderr, ffmpegCmdStderrPipe)
 	if err != nil {
-		log("copy from ffmpeg stderr: %v", err)
+		logctx(ctx, "copy from ffmpeg stderr: %v", err)
 	}
+	<-ffmpegprogressdone
 
 	err = ffmpegCmd.Wait()
 	if err != nil {
-		return fmt.Errorf("ffmpeg Wait: %w", err)
+		return &TranscodeError{Err: fmt.Errorf("ffmpeg Wait: %w", err)}
 	}
 
-	log("transcoded in %v", time.Since(t0).Truncate(time.Second))
-
 	return nil
 }
 
 func (config *TgZeConfig) Get() error {
-	req, err := http.NewRequest(http.MethodGet, config.YssUrl, nil)
-	if err != nil {
-		return err
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("yss response status %s", resp.Status)
-	}
-
-	rbb, err := io.ReadAll(resp.Body)
+	rbb, _, err := config.Store.Get()
 	if err != nil {
 		return err
 	}
@@ -1767,34 +2591,12 @@ func (config *TgZeConfig) Get() error {
 		return err
 	}
 
-	if config.DEBUG {
-		log("DEBUG Config.Get: %+v", config)
-	}
-
-	return nil
-}
-
-func (config *TgZeConfig) Put() error {
-	if config.DEBUG {
-		log("DEBUG Config.Put %s %+v", config.YssUrl, config)
-	}
-
-	rbb, err := yaml.Marshal(config)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest(http.MethodPut, config.YssUrl, bytes.NewBuffer(rbb))
-	if err != nil {
+	if err := config.GetSecrets(); err != nil {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("yss response status %s", resp.Status)
+	if config.DEBUG {
+		log("DEBUG Config.Get: %+v", config.Redacted())
 	}
 
 	return nil
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestYtparseDuration(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want time.Duration
+		ok   bool
+	}{
+		{"PT15S", 15 * time.Second, true},
+		{"PT4M13S", 4*time.Minute + 13*time.Second, true},
+		{"PT1H2M3S", time.Hour + 2*time.Minute + 3*time.Second, true},
+		{"PT2H", 2 * time.Hour, true},
+		{"P1DT1H", 25 * time.Hour, true},
+		{"P2W", 14 * 24 * time.Hour, true},
+		{"P0D", 0, true},
+		{"PT", 0, true},
+		{"T1M", 0, false},
+		{"PT1X", 0, false},
+		{"PTM", 0, false},
+		// minutes and not months before the T
+		{"P1M", 0, false},
+		{"P1H", 0, false},
+	} {
+		d, err := ytparseDuration(tt.s)
+		if (err == nil) != tt.ok || d != tt.want {
+			t.Errorf("ytparseDuration(%q) = %v %v, want %v ok:%v", tt.s, d, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestYtlistoptions(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		want YtListOptions
+		ok   bool
+	}{
+		{"", YtListOptions{}, true},
+		{"the playlist youtube.com/playlist?list=x", YtListOptions{}, true},
+		{"items=5-20", YtListOptions{ItemsFrom: 5, ItemsTo: 20}, true},
+		{"items=5", YtListOptions{ItemsFrom: 5, ItemsTo: 5}, true},
+		{"items=5-", YtListOptions{ItemsFrom: 5}, true},
+		{"items=0-3", YtListOptions{}, false},
+		{"items=5-3", YtListOptions{}, false},
+		{"items=a", YtListOptions{}, false},
+		{"reverse=yes shuffle=yes", YtListOptions{Reverse: true, Shuffle: true}, true},
+		{"Reverse=YES reverse=no", YtListOptions{}, true},
+		{"reverse", YtListOptions{}, true},
+		{"reverse=1", YtListOptions{}, false},
+		{"latest=10", YtListOptions{Latest: 10}, true},
+		{"latest=0", YtListOptions{}, false},
+		{"since=2024-01-01 new=yes", YtListOptions{Since: "2024-01-01", New: true}, true},
+		{"since=2024-13-01", YtListOptions{}, false},
+		{"new=maybe", YtListOptions{}, false},
+		{"other=option", YtListOptions{}, true},
+	} {
+		o, err := ytlistoptions(tt.text)
+		if (err == nil) != tt.ok {
+			t.Errorf("ytlistoptions(%q) error = %v, want ok:%v", tt.text, err, tt.ok)
+			continue
+		}
+		if tt.ok && o != tt.want {
+			t.Errorf("ytlistoptions(%q) = %+v, want %+v", tt.text, o, tt.want)
+		}
+	}
+}
+
+func TestYtlistfilter(t *testing.T) {
+	testState(t)
+	const chatid = -100
+	State.TgPostedVideos = map[int64][]string{chatid: {"b", "d"}}
+
+	videos := []YtVideo{
+		{Id: "a", PlaylistIndex: 0, PublishedAt: "2024-01-05T10:00:00Z"},
+		{Id: "b", PlaylistIndex: 1, PublishedAt: "2024-03-01T10:00:00Z"},
+		{Id: "c", PlaylistIndex: 2, PublishedAt: "2023-12-31T23:00:00Z"},
+		{Id: "d", PlaylistIndex: 3, PublishedAt: "2024-02-01T10:00:00Z"},
+		{Id: "e", PlaylistIndex: 4, PublishedAt: "2024-01-01T00:00:00Z"},
+	}
+	for _, tt := range []struct {
+		name string
+		o    YtListOptions
+		want []string
+	}{
+		{"all", YtListOptions{}, []string{"a", "b", "c", "d", "e"}},
+		{"items", YtListOptions{ItemsFrom: 2, ItemsTo: 4}, []string{"b", "c", "d"}},
+		{"items from", YtListOptions{ItemsFrom: 4}, []string{"d", "e"}},
+		{"since", YtListOptions{Since: "2024-01-01"}, []string{"a", "b", "d", "e"}},
+		{"latest keeps the playlist order", YtListOptions{Latest: 2}, []string{"b", "d"}},
+		{"reverse", YtListOptions{Reverse: true}, []string{"e", "d", "c", "b", "a"}},
+		{"new", YtListOptions{New: true}, []string{"a", "c", "e"}},
+		{"new latest reverse", YtListOptions{New: true, Latest: 2, Reverse: true}, []string{"e", "a"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, v := range ytlistfilter(videos, tt.o, chatid) {
+				got = append(got, v.Id)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ytlistfilter(%+v) = %v, want %v", tt.o, got, tt.want)
+			}
+		})
+	}
+
+	o := YtListOptions{Shuffle: true}
+	var got []string
+	for _, v := range ytlistfilter(videos, o, chatid) {
+		got = append(got, v.Id)
+	}
+	slices.Sort(got)
+	if want := []string{"a", "b", "c", "d", "e"}; !slices.Equal(got, want) {
+		t.Errorf("ytlistfilter(%+v) = %v, want the same videos", o, got)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ytdl "github.com/kkdai/youtube/v2"
+)
+
+var ErrNoSpace = errors.New("not enough free disk space")
+
+// workdirInit creates WorkDir and removes the job dirs left there by a previous run that did not finish
+func workdirInit() error {
+	dir := Config().WorkDir
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("os.MkdirAll `%s`: %w", dir, err)
+	}
+	ee, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("os.ReadDir `%s`: %w", dir, err)
+	}
+	for _, e := range ee {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), "job") {
+			continue
+		}
+		log("WorkDir removing orphan `%s`", e.Name())
+		removeAll(filepath.Join(dir, e.Name()))
+	}
+	return nil
+}
+
+// workdirJob creates the dir for the files of the job, it is unique even for the same video in two jobs
+func workdirJob(jobid int64) (string, error) {
+	dir, err := os.MkdirTemp(Config().WorkDir, fmt.Sprintf("job%d.", jobid))
+	if err != nil {
+		return "", fmt.Errorf("os.MkdirTemp: %w", err)
+	}
+	return dir, nil
+}
+
+// workdirCheck fails if the disk of the dir has less than the needed size plus WorkDirMinFreeBytes free
+func workdirCheck(dir string, need int64) error {
+	free, err := diskFree(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("diskFree `%s`: %w", dir, err)
+	}
+	if free < need+Config().WorkDirMinFreeBytes {
+		return fmt.Errorf("need %dmb free %dmb: %w", need>>20, free>>20, ErrNoSpace)
+	}
+	return nil
+}
+
+// ytformatSize is the size of the format or the estimate from its bitrate if youtube does not tell it
+func ytformatSize(f ytdl.Format, duration time.Duration) int64 {
+	if f.ContentLength > 0 {
+		return f.ContentLength
+	}
+	return int64(f.Bitrate / 8 * int(duration.Seconds()))
+}
+
+func removeAll(path string) {
+	if err := os.RemoveAll(path); err != nil {
+		log("os.RemoveAll `%s`: %v", path, err)
+	}
+}